@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// revokeURL is the endpoint for revoking Google OAuth tokens.
+var revokeURL = "https://oauth2.googleapis.com/revoke"
+
+const loginHelp = `Authorize gmailfilters and save the token, replacing any saved token.`
+
+func (cmd *loginCommand) Name() string      { return "login" }
+func (cmd *loginCommand) Args() string      { return "" }
+func (cmd *loginCommand) ShortHelp() string { return loginHelp }
+func (cmd *loginCommand) LongHelp() string  { return loginHelp }
+func (cmd *loginCommand) Hidden() bool      { return false }
+
+func (cmd *loginCommand) Register(fs *flag.FlagSet) {}
+
+type loginCommand struct{}
+
+func (cmd *loginCommand) Run(ctx context.Context, args []string) error {
+	if applyExisting {
+		requestModifyScope()
+	}
+
+	config, err := getOAuthConfig()
+	if err != nil {
+		return err
+	}
+
+	store, err := getTokenStore()
+	if err != nil {
+		return err
+	}
+
+	tok, err := authorize(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Put(account, tok); err != nil {
+		return err
+	}
+
+	fmt.Printf("Logged in, the token for account %s is saved\n", account)
+	return nil
+}
+
+const logoutHelp = `Revoke the saved token and delete it.`
+
+func (cmd *logoutCommand) Name() string      { return "logout" }
+func (cmd *logoutCommand) Args() string      { return "" }
+func (cmd *logoutCommand) ShortHelp() string { return logoutHelp }
+func (cmd *logoutCommand) LongHelp() string  { return logoutHelp }
+func (cmd *logoutCommand) Hidden() bool      { return false }
+
+func (cmd *logoutCommand) Register(fs *flag.FlagSet) {}
+
+type logoutCommand struct{}
+
+func (cmd *logoutCommand) Run(ctx context.Context, args []string) error {
+	store, err := getTokenStore()
+	if err != nil {
+		return err
+	}
+
+	tok, err := store.Get(account)
+	if os.IsNotExist(err) {
+		fmt.Printf("Not logged in, there is no token for account %s\n", account)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting token for account %s failed: %v", account, err)
+	}
+
+	// Still delete the token if it cannot be revoked, it might already have
+	// been revoked.
+	if err := revokeToken(ctx, tok); err != nil {
+		logrus.Warnf("Revoking token failed: %v", err)
+	}
+
+	if err := store.Delete(account); err != nil {
+		return fmt.Errorf("deleting token for account %s failed: %v", account, err)
+	}
+
+	fmt.Println("Logged out")
+	return nil
+}
+
+// revokeToken revokes a token with Google. Revoking the refresh token also
+// revokes the access tokens made with it.
+func revokeToken(ctx context.Context, tok *oauth2.Token) error {
+	token := tok.RefreshToken
+	if len(token) < 1 {
+		token = tok.AccessToken
+	}
+
+	req, err := http.NewRequest(http.MethodPost, revokeURL+"?"+url.Values{"token": {token}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("revoke endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+const whoamiHelp = `Print the email address of the account the credentials are for.`
+
+func (cmd *whoamiCommand) Name() string      { return "whoami" }
+func (cmd *whoamiCommand) Args() string      { return "" }
+func (cmd *whoamiCommand) ShortHelp() string { return whoamiHelp }
+func (cmd *whoamiCommand) LongHelp() string  { return whoamiHelp }
+func (cmd *whoamiCommand) Hidden() bool      { return false }
+
+func (cmd *whoamiCommand) Register(fs *flag.FlagSet) {}
+
+type whoamiCommand struct{}
+
+func (cmd *whoamiCommand) Run(ctx context.Context, args []string) error {
+	for _, user := range getUsers() {
+		api, err := newAPIBackend(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		addr, err := api.EmailAddress()
+		if err != nil {
+			return fmt.Errorf("getting email address failed: %v", err)
+		}
+
+		fmt.Println(addr)
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// backend defines the filter and label operations we need from a mail
+// account.
+type backend interface {
+	// ListFilters lists the filters on the account.
+	ListFilters() ([]*gmail.Filter, error)
+	// CreateFilter creates a filter on the account.
+	CreateFilter(f *gmail.Filter) (*gmail.Filter, error)
+	// DeleteFilter deletes the filter with the ID passed from the account.
+	DeleteFilter(id string) error
+
+	// ListLabels lists the labels on the account.
+	ListLabels() ([]*gmail.Label, error)
+	// CreateLabel creates a label on the account.
+	CreateLabel(l *gmail.Label) (*gmail.Label, error)
+	// DeleteLabel deletes the label with the ID passed from the account.
+	DeleteLabel(id string) error
+
+	// ListMessages lists the IDs of the messages matching the search query,
+	// a page at a time. The next page token is empty on the last page.
+	ListMessages(query, pageToken string) ([]string, string, error)
+	// BatchModifyMessages adds and removes labels on the messages with the
+	// IDs passed.
+	BatchModifyMessages(ids, addLabelIds, removeLabelIds []string) error
+}
+
+// gmailBackend is a backend for an account using the Gmail API.
+type gmailBackend struct {
+	svc  *gmail.Service
+	user string
+}
+
+// newGmailBackend returns a backend for the user's account using the Gmail
+// service passed.
+func newGmailBackend(svc *gmail.Service, user string) *gmailBackend {
+	return &gmailBackend{
+		svc:  svc,
+		user: user,
+	}
+}
+
+// ListFilters lists the filters on the account.
+func (g *gmailBackend) ListFilters() ([]*gmail.Filter, error) {
+	l, err := g.svc.Users.Settings.Filters.List(g.user).Do()
+	if err != nil {
+		return nil, err
+	}
+	return l.Filter, nil
+}
+
+// CreateFilter creates a filter on the account.
+func (g *gmailBackend) CreateFilter(f *gmail.Filter) (*gmail.Filter, error) {
+	return g.svc.Users.Settings.Filters.Create(g.user, f).Do()
+}
+
+// DeleteFilter deletes the filter with the ID passed from the account.
+func (g *gmailBackend) DeleteFilter(id string) error {
+	return g.svc.Users.Settings.Filters.Delete(g.user, id).Do()
+}
+
+// ListLabels lists the labels on the account.
+func (g *gmailBackend) ListLabels() ([]*gmail.Label, error) {
+	l, err := g.svc.Users.Labels.List(g.user).Do()
+	if err != nil {
+		return nil, err
+	}
+	return l.Labels, nil
+}
+
+// CreateLabel creates a label on the account.
+func (g *gmailBackend) CreateLabel(l *gmail.Label) (*gmail.Label, error) {
+	return g.svc.Users.Labels.Create(g.user, l).Do()
+}
+
+// DeleteLabel deletes the label with the ID passed from the account.
+func (g *gmailBackend) DeleteLabel(id string) error {
+	return g.svc.Users.Labels.Delete(g.user, id).Do()
+}
+
+// ListMessages lists the IDs of the messages matching the search query, a
+// page at a time.
+func (g *gmailBackend) ListMessages(query, pageToken string) ([]string, string, error) {
+	l, err := g.svc.Users.Messages.List(g.user).Q(query).PageToken(pageToken).Do()
+	if err != nil {
+		return nil, "", err
+	}
+	ids := make([]string, 0, len(l.Messages))
+	for _, m := range l.Messages {
+		ids = append(ids, m.Id)
+	}
+	return ids, l.NextPageToken, nil
+}
+
+// BatchModifyMessages adds and removes labels on the messages with the IDs
+// passed.
+func (g *gmailBackend) BatchModifyMessages(ids, addLabelIds, removeLabelIds []string) error {
+	return g.svc.Users.Messages.BatchModify(g.user, &gmail.BatchModifyMessagesRequest{
+		Ids:            ids,
+		AddLabelIds:    addLabelIds,
+		RemoveLabelIds: removeLabelIds,
+	}).Do()
+}
+
+// EmailAddress returns the primary email address of the account.
+func (g *gmailBackend) EmailAddress() (string, error) {
+	l, err := g.svc.Users.Settings.SendAs.List(g.user).Do()
+	if err != nil {
+		return "", err
+	}
+	for _, sendAs := range l.SendAs {
+		if sendAs.IsPrimary {
+			return sendAs.SendAsEmail, nil
+		}
+	}
+	return "", errors.New("the account has no primary email address")
+}
+
+// errDryRun is returned when something tries to change an account in dry run
+// mode.
+var errDryRun = errors.New("cannot change the account in dry run mode")
+
+// dryRunBackend wraps a backend so nothing on the account can be changed.
+// Labels that would be created are given placeholder IDs so the filters
+// using them can still be planned.
+type dryRunBackend struct {
+	backend
+}
+
+// CreateFilter returns an error since filters cannot be created in dry run
+// mode.
+func (d dryRunBackend) CreateFilter(f *gmail.Filter) (*gmail.Filter, error) {
+	return nil, errDryRun
+}
+
+// DeleteFilter returns an error since filters cannot be deleted in dry run
+// mode.
+func (d dryRunBackend) DeleteFilter(id string) error {
+	return errDryRun
+}
+
+// CreateLabel returns the label passed with a placeholder ID without creating
+// it.
+func (d dryRunBackend) CreateLabel(l *gmail.Label) (*gmail.Label, error) {
+	return &gmail.Label{
+		Id:   plannedLabelPrefix + l.Name,
+		Name: l.Name,
+	}, nil
+}
+
+// DeleteLabel returns an error since labels cannot be deleted in dry run
+// mode.
+func (d dryRunBackend) DeleteLabel(id string) error {
+	return errDryRun
+}
+
+// BatchModifyMessages returns an error since messages cannot be changed in dry
+// run mode.
+func (d dryRunBackend) BatchModifyMessages(ids, addLabelIds, removeLabelIds []string) error {
+	return errDryRun
+}
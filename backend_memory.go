@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jessfraz/gmailfilters/query"
+	"google.golang.org/api/gmail/v1"
+)
+
+// systemLabels are the labels every Gmail account has.
+var systemLabels = []string{
+	"CHAT",
+	"SENT",
+	"INBOX",
+	"IMPORTANT",
+	"TRASH",
+	"DRAFT",
+	"SPAM",
+	"CATEGORY_FORUMS",
+	"CATEGORY_UPDATES",
+	"CATEGORY_PERSONAL",
+	"CATEGORY_PROMOTIONS",
+	"CATEGORY_SOCIAL",
+	"STARRED",
+	"UNREAD",
+}
+
+// memoryPageSize is the most message IDs ListMessages returns at once.
+const memoryPageSize = 100
+
+// memoryBackend is a backend that keeps the filters, labels and messages of a
+// fake account in memory. It is safe for concurrent use.
+type memoryBackend struct {
+	mu       sync.Mutex
+	filters  []*gmail.Filter
+	labels   []*gmail.Label
+	messages []*memoryMessage
+	lastID   int
+}
+
+// memoryMessage is a message on a fake account.
+type memoryMessage struct {
+	id       string
+	msg      *query.Message
+	labelIds []string
+}
+
+// newMemoryBackend returns a backend for an empty fake account that only has
+// the system labels.
+func newMemoryBackend() *memoryBackend {
+	m := &memoryBackend{}
+	for _, name := range systemLabels {
+		m.labels = append(m.labels, &gmail.Label{
+			Id:   name,
+			Name: name,
+			Type: "system",
+		})
+	}
+	return m
+}
+
+// ListFilters lists the filters on the account.
+func (m *memoryBackend) ListFilters() ([]*gmail.Filter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	filters := make([]*gmail.Filter, 0, len(m.filters))
+	for _, f := range m.filters {
+		filters = append(filters, copyFilter(f))
+	}
+	return filters, nil
+}
+
+// CreateFilter creates a filter on the account.
+func (m *memoryBackend) CreateFilter(f *gmail.Filter) (*gmail.Filter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if f.Criteria == nil || f.Action == nil {
+		return nil, fmt.Errorf("filter must have both criteria and an action")
+	}
+
+	// Gmail does not allow duplicate filters.
+	key := filterKey(f)
+	for _, existing := range m.filters {
+		if filterKey(existing) == key {
+			return nil, fmt.Errorf("filter already exists")
+		}
+	}
+
+	// Make sure all the labels exist.
+	for _, id := range append(append([]string{}, f.Action.AddLabelIds...), f.Action.RemoveLabelIds...) {
+		if m.findLabel(id) == nil {
+			return nil, fmt.Errorf("invalid label %s", id)
+		}
+	}
+
+	created := copyFilter(f)
+	created.Id = m.nextID("filter")
+	m.filters = append(m.filters, created)
+
+	return copyFilter(created), nil
+}
+
+// DeleteFilter deletes the filter with the ID passed from the account.
+func (m *memoryBackend) DeleteFilter(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, f := range m.filters {
+		if f.Id == id {
+			m.filters = append(m.filters[:i], m.filters[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("filter %s not found", id)
+}
+
+// ListLabels lists the labels on the account.
+func (m *memoryBackend) ListLabels() ([]*gmail.Label, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := make([]*gmail.Label, 0, len(m.labels))
+	for _, l := range m.labels {
+		label := *l
+		labels = append(labels, &label)
+	}
+	return labels, nil
+}
+
+// CreateLabel creates a label on the account.
+func (m *memoryBackend) CreateLabel(l *gmail.Label) (*gmail.Label, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(l.Name) < 1 {
+		return nil, fmt.Errorf("label name cannot be empty")
+	}
+
+	// Gmail label names are case insensitive.
+	for _, existing := range m.labels {
+		if strings.EqualFold(existing.Name, l.Name) {
+			return nil, fmt.Errorf("label name %s exists or conflicts", l.Name)
+		}
+	}
+
+	created := &gmail.Label{
+		Id:   m.nextID("Label"),
+		Name: l.Name,
+		Type: "user",
+	}
+	m.labels = append(m.labels, created)
+
+	label := *created
+	return &label, nil
+}
+
+// DeleteLabel deletes the label with the ID passed from the account.
+func (m *memoryBackend) DeleteLabel(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, l := range m.labels {
+		if l.Id == id {
+			if l.Type == "system" {
+				return fmt.Errorf("cannot delete system label %s", id)
+			}
+			m.labels = append(m.labels[:i], m.labels[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("label %s not found", id)
+}
+
+// ListMessages lists the IDs of the messages matching the search query, a
+// page at a time. Like Gmail, messages in the spam and trash are left out.
+func (m *memoryBackend) ListMessages(q, pageToken string) ([]string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n, err := query.Parse(q)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid query %q: %v", q, err)
+	}
+
+	start := 0
+	if len(pageToken) > 0 {
+		if start, err = strconv.Atoi(pageToken); err != nil {
+			return nil, "", fmt.Errorf("invalid page token %q", pageToken)
+		}
+	}
+
+	var ids []string
+	for _, msg := range m.messages {
+		if hasLabel(msg.labelIds, "SPAM") || hasLabel(msg.labelIds, "TRASH") {
+			continue
+		}
+
+		// Match against the labels the message has now.
+		matched := *msg.msg
+		matched.Labels = nil
+		for _, id := range msg.labelIds {
+			if l := m.findLabel(id); l != nil {
+				matched.Labels = append(matched.Labels, l.Name)
+			}
+		}
+		if query.Match(n, &matched) {
+			ids = append(ids, msg.id)
+		}
+	}
+
+	if start > len(ids) {
+		start = len(ids)
+	}
+	if len(ids)-start > memoryPageSize {
+		return ids[start : start+memoryPageSize], strconv.Itoa(start + memoryPageSize), nil
+	}
+	return ids[start:], "", nil
+}
+
+// BatchModifyMessages adds and removes labels on the messages with the IDs
+// passed.
+func (m *memoryBackend) BatchModifyMessages(ids, addLabelIds, removeLabelIds []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range append(append([]string{}, addLabelIds...), removeLabelIds...) {
+		if m.findLabel(id) == nil {
+			return fmt.Errorf("invalid label %s", id)
+		}
+	}
+
+	// Check all the messages exist before changing any of them.
+	messages := make([]*memoryMessage, 0, len(ids))
+	for _, id := range ids {
+		msg := m.findMessage(id)
+		if msg == nil {
+			return fmt.Errorf("message %s not found", id)
+		}
+		messages = append(messages, msg)
+	}
+
+	for _, msg := range messages {
+		for _, id := range addLabelIds {
+			msg.labelIds = appendUnique(msg.labelIds, id)
+		}
+		labelIds := msg.labelIds[:0]
+		for _, id := range msg.labelIds {
+			if !hasLabel(removeLabelIds, id) {
+				labelIds = append(labelIds, id)
+			}
+		}
+		msg.labelIds = labelIds
+	}
+
+	return nil
+}
+
+// addMessage adds a message with the labels passed to the account and
+// returns its ID.
+func (m *memoryBackend) addMessage(msg *query.Message, labelIds ...string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.nextID("msg")
+	m.messages = append(m.messages, &memoryMessage{
+		id:       id,
+		msg:      msg,
+		labelIds: append([]string{}, labelIds...),
+	})
+	return id
+}
+
+// messageLabels returns the IDs of the labels on the message with the ID
+// passed.
+func (m *memoryBackend) messageLabels(id string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if msg := m.findMessage(id); msg != nil {
+		return append([]string{}, msg.labelIds...)
+	}
+	return nil
+}
+
+func (m *memoryBackend) findMessage(id string) *memoryMessage {
+	for _, msg := range m.messages {
+		if msg.id == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) findLabel(id string) *gmail.Label {
+	for _, l := range m.labels {
+		if l.Id == id {
+			return l
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) nextID(prefix string) string {
+	m.lastID++
+	return fmt.Sprintf("%s_%d", prefix, m.lastID)
+}
+
+// copyFilter returns a deep copy of a Gmail filter.
+func copyFilter(f *gmail.Filter) *gmail.Filter {
+	c := *f
+	if f.Criteria != nil {
+		criteria := *f.Criteria
+		c.Criteria = &criteria
+	}
+	if f.Action != nil {
+		action := *f.Action
+		action.AddLabelIds = append([]string{}, f.Action.AddLabelIds...)
+		action.RemoveLabelIds = append([]string{}, f.Action.RemoveLabelIds...)
+		c.Action = &action
+	}
+	return &c
+}
+
+func hasLabel(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/gmail/v1"
+)
+
+const testFilterFile = `
+[[filter]]
+query = "to:your_activity@noreply.github.com"
+archive = true
+read = true
+
+[[filter]]
+query = "from:notifications@github.com LGTM"
+label = "github/LGTM"
+
+[[filter]]
+queryOr = [
+"to:plans@tripit.com",
+"to:receipts@expensify.com"
+]
+delete = true
+
+[[filter]]
+query = "list:coreos-dev@googlegroups.com"
+label = "Mailing Lists/coreos-dev"
+archiveUnlessToMe = true
+`
+
+func TestSyncRoundTrip(t *testing.T) {
+	api, s := newFakeGmailBackend(t, newMemoryBackend())
+	defer s.Close()
+
+	backends := map[string]backend{
+		"memory": newMemoryBackend(),
+		"gmail":  api,
+	}
+
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			filters, err := decodeFile(writeTestFile(t, "filters.toml", testFilterFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The first sync should create all the filters.
+			diff, err := syncFilters(b, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(diff.create) != 5 || len(diff.delete) != 0 || diff.unchanged != 0 {
+				t.Fatalf("expected 5 filters to be created, got %d created, %d deleted, %d unchanged", len(diff.create), len(diff.delete), diff.unchanged)
+			}
+
+			// Syncing again should not touch anything.
+			diff, err = syncFilters(b, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(diff.create) != 0 || len(diff.delete) != 0 || diff.unchanged != 5 {
+				t.Fatalf("expected 5 filters to be unchanged, got %d created, %d deleted, %d unchanged", len(diff.create), len(diff.delete), diff.unchanged)
+			}
+
+			// Removing a filter from the config should only delete that filter.
+			diff, err = syncFilters(b, filters[1:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(diff.create) != 0 || len(diff.delete) != 1 || diff.unchanged != 4 {
+				t.Fatalf("expected 1 filter to be deleted, got %d created, %d deleted, %d unchanged", len(diff.create), len(diff.delete), diff.unchanged)
+			}
+		})
+	}
+}
+
+func TestDryRunDoesNotChangeAccount(t *testing.T) {
+	m := newMemoryBackend()
+
+	filters, err := decodeFile(writeTestFile(t, "filters.toml", testFilterFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := planSync(dryRunBackend{m}, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"Mailing Lists/coreos-dev", "github/LGTM"}, diff.labels); diff != "" {
+		t.Fatalf("got diff: %s", diff)
+	}
+	if len(diff.create) != 5 {
+		t.Fatalf("expected 5 filters to be created, got %d", len(diff.create))
+	}
+
+	existing, err := m.ListFilters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels, err := m.ListLabels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(existing) != 0 || len(labels) != len(systemLabels) {
+		t.Fatalf("expected the account to be untouched, got %d filters and %d labels", len(existing), len(labels))
+	}
+}
+
+func TestExportReimport(t *testing.T) {
+	// Use the Gmail API backend for the source so the export goes through
+	// the REST server.
+	src := newMemoryBackend()
+	b, s := newFakeGmailBackend(t, src)
+	defer s.Close()
+
+	filters, err := decodeFile(writeTestFile(t, "filters.toml", `
+[[filter]]
+query = "to:your_activity@noreply.github.com"
+archive = true
+read = true
+
+[[filter]]
+query = "from:notifications@github.com LGTM"
+label = "github/LGTM"
+
+[[filter]]
+queryOr = [
+"to:plans@tripit.com",
+"to:receipts@expensify.com"
+]
+delete = true
+
+[[filter]]
+query = "from:builds@travis-ci.org"
+labels = ["ci", "ci/travis"]
+removeLabels = ["github/LGTM"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syncFilters(b, filters); err != nil {
+		t.Fatal(err)
+	}
+
+	// Export the filters and import them into a new account.
+	exported := writeTestFile(t, "exported.toml", "")
+	if err := exportExistingFilters(b, exported); err != nil {
+		t.Fatal(err)
+	}
+	reimported, err := decodeFile(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newMemoryBackend()
+	if _, err := syncFilters(dst, reimported); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(filterKeys(t, src), filterKeys(t, dst)); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	src := newMemoryBackend()
+
+	// Create the labels the filters use.
+	labelIDs := map[string]string{}
+	for _, name := range []string{"github", "github/mentions", "Mailing Lists/coreos-dev", "receipts"} {
+		l, err := src.CreateLabel(&gmail.Label{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		labelIDs[name] = l.Id
+	}
+
+	// Add filters like the ones you could create in the web UI.
+	for _, f := range []*gmail.Filter{
+		{
+			Criteria: &gmail.FilterCriteria{From: "notifications@github.com"},
+			Action:   &gmail.FilterAction{AddLabelIds: []string{labelIDs["github"], labelIDs["github/mentions"], "IMPORTANT"}},
+		},
+		{
+			Criteria: &gmail.FilterCriteria{To: "receipts@example.com", Subject: "receipt"},
+			Action:   &gmail.FilterAction{AddLabelIds: []string{labelIDs["receipts"], "CATEGORY_UPDATES"}, RemoveLabelIds: []string{"INBOX"}, Forward: "accounting@example.com"},
+		},
+		{
+			Criteria: &gmail.FilterCriteria{Query: "from:boss@example.com", NegatedQuery: "lunch"},
+			Action:   &gmail.FilterAction{AddLabelIds: []string{"STARRED"}, RemoveLabelIds: []string{"SPAM"}},
+		},
+		{
+			Criteria: &gmail.FilterCriteria{HasAttachment: true, Size: 10485760, SizeComparison: "larger"},
+			Action:   &gmail.FilterAction{RemoveLabelIds: []string{"IMPORTANT", "UNREAD"}},
+		},
+		{
+			Criteria: &gmail.FilterCriteria{Query: "list:coreos-dev@googlegroups.com", To: "me"},
+			Action:   &gmail.FilterAction{AddLabelIds: []string{labelIDs["Mailing Lists/coreos-dev"]}},
+		},
+		{
+			Criteria: &gmail.FilterCriteria{Query: "list:coreos-dev@googlegroups.com", NegatedQuery: "to:me"},
+			Action:   &gmail.FilterAction{AddLabelIds: []string{labelIDs["Mailing Lists/coreos-dev"]}, RemoveLabelIds: []string{"INBOX"}},
+		},
+		{
+			// Only one half of an archiveUnlessToMe pair.
+			Criteria: &gmail.FilterCriteria{Query: "list:xdg-app@lists.freedesktop.org", NegatedQuery: "to:me"},
+			Action:   &gmail.FilterAction{RemoveLabelIds: []string{"INBOX"}},
+		},
+		{
+			Criteria: &gmail.FilterCriteria{Query: "to:plans@tripit.com", ExcludeChats: true},
+			Action:   &gmail.FilterAction{AddLabelIds: []string{"TRASH"}},
+		},
+	} {
+		if _, err := src.CreateFilter(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Export the filters and import them into a new account.
+	exported := writeTestFile(t, "exported.toml", "")
+	if err := exportExistingFilters(src, exported); err != nil {
+		t.Fatal(err)
+	}
+	reimported, err := decodeFile(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The archiveUnlessToMe pair should have been merged.
+	if len(reimported) != 7 {
+		t.Fatalf("expected 7 filters to be exported, got %d", len(reimported))
+	}
+
+	dst := newMemoryBackend()
+	if _, err := syncFilters(dst, reimported); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(filterKeys(t, src), filterKeys(t, dst)); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// Exporting the new account should give us the same file.
+	again := writeTestFile(t, "again.toml", "")
+	if err := exportExistingFilters(dst, again); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(want), string(got)); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+// filterKeys returns the sorted keys of the filters on the account with the
+// label IDs replaced by their names, so filters on different accounts can be
+// compared.
+func filterKeys(t *testing.T, b backend) []string {
+	filters, err := b.ListFilters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := getLabelMapOnID(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for _, f := range filters {
+		f.Action.AddLabelIds = labelIDsToNames(f.Action.AddLabelIds, names)
+		f.Action.RemoveLabelIds = labelIDsToNames(f.Action.RemoveLabelIds, names)
+		keys = append(keys, filterKey(f))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func labelIDsToNames(ids []string, names map[string]string) []string {
+	out := []string{}
+	for _, id := range ids {
+		out = append(out, names[id])
+	}
+	return out
+}
+
+// writeTestFile writes a file with the content passed into a new directory
+// under testDir.
+func writeTestFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
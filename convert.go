@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const convertHelp = `Convert a filter config to another format, like the mailFilters.xml of the Gmail settings or Sieve.`
+
+const convertLongHelp = convertHelp + `
+
+The output format is picked from the extension of OUTPUT, or the --to flag.
+A mailFilters.xml file can be imported in the Gmail settings under "Filters
+and Blocked Addresses", without any API credentials. Includes, variables and
+templates are expanded, and filter names are lost in mailFilters.xml.
+
+A Sieve script can be used with Fastmail, Dovecot and other servers. Sieve
+does not know our addresses, so pass them with --me to convert to:me and
+archiveUnlessToMe. Anything that cannot be converted to or from Sieve is
+reported and left out.`
+
+func (cmd *convertCommand) Name() string      { return "convert" }
+func (cmd *convertCommand) Args() string      { return "FILE OUTPUT" }
+func (cmd *convertCommand) ShortHelp() string { return convertHelp }
+func (cmd *convertCommand) LongHelp() string  { return convertLongHelp }
+func (cmd *convertCommand) Hidden() bool      { return false }
+
+func (cmd *convertCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.to, "to", "", "format to convert to: toml, yaml, json, xml or sieve (default from the extension of the output)")
+	fs.StringVar(&cmd.me, "me", "", "comma separated addresses that match me in queries like to:me, for sieve")
+}
+
+type convertCommand struct {
+	to string
+	me string
+}
+
+func (cmd *convertCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errors.New("must pass a path to a gmail filter configuration file and a path to write the converted file to")
+	}
+
+	to := extensionFormat(args[1])
+	if len(cmd.to) > 0 {
+		var err error
+		to, err = checkFormat(cmd.to)
+		if err != nil {
+			return err
+		}
+	}
+
+	filters, err := decodeFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	var me []string
+	for _, addr := range strings.Split(cmd.me, ",") {
+		if addr = strings.TrimSpace(addr); len(addr) > 0 {
+			me = append(me, addr)
+		}
+	}
+
+	skipped, err := convertFilters(filterfile{Filter: filters}, args[1], to, me)
+	if err != nil {
+		return err
+	}
+
+	if skipped > 0 {
+		fmt.Printf("Converted %d filters to %s, skipped %d that could not be converted\n", len(filters)-skipped, args[1], skipped)
+		return nil
+	}
+	fmt.Printf("Converted %d filters to %s\n", len(filters), args[1])
+	return nil
+}
+
+// convertFilters writes the filters to a file in the format passed. The me
+// addresses are used for to:me in Sieve. It returns the number of filters
+// skipped since they could not be converted.
+func convertFilters(ff filterfile, file, format string, me []string) (int, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, fmt.Errorf("creating %s failed: %v", file, err)
+	}
+	defer f.Close()
+
+	var skipped int
+	if format == "sieve" {
+		skipped, err = encodeSieve(f, ff, me)
+	} else {
+		skipped, err = encodeFilterfile(f, format, ff)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("writing %s failed: %v", file, err)
+	}
+
+	return skipped, f.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// batchModifyLimit is the most message IDs BatchModify takes at once.
+const batchModifyLimit = 1000
+
+// applyToExisting applies the filters to the messages already in the account,
+// adding and removing the same labels the filters would on new mail. Only the
+// filters with applyToExisting set are applied, unless all is true. In dry run
+// mode the matching messages are counted but not changed.
+func applyToExisting(w io.Writer, b backend, filters []filter, all bool) error {
+	labels, err := getLabelMap(b)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range filters {
+		if !all && !f.ApplyToExisting {
+			continue
+		}
+		if len(f.ForwardTo) > 0 {
+			logrus.Warnf("%s: existing messages are not forwarded to %s", f.pos, f.ForwardTo)
+		}
+
+		gmailFilters, err := f.toGmailFilters(&labels)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.pos, err)
+		}
+
+		// A message can match more than one of the Gmail filters, like the
+		// ones for archiveUnlessToMe, so only count it once.
+		matched := map[string]bool{}
+		for _, gf := range gmailFilters {
+			a := gf.Action
+			if a == nil || (len(a.AddLabelIds) == 0 && len(a.RemoveLabelIds) == 0) {
+				continue
+			}
+
+			q := criteriaQuery(gf.Criteria)
+			ids, err := listAllMessages(b, q)
+			if err != nil {
+				return fmt.Errorf("%s: listing messages matching %q failed: %v", f.pos, q, err)
+			}
+			for _, id := range ids {
+				matched[id] = true
+			}
+
+			if dryRun {
+				continue
+			}
+			for len(ids) > 0 {
+				n := len(ids)
+				if n > batchModifyLimit {
+					n = batchModifyLimit
+				}
+				logrus.WithFields(logrus.Fields{
+					"query":    q,
+					"messages": n,
+				}).Debug("modifying Gmail messages")
+				if err := b.BatchModifyMessages(ids[:n], a.AddLabelIds, a.RemoveLabelIds); err != nil {
+					return fmt.Errorf("%s: modifying messages failed: %v", f.pos, err)
+				}
+				ids = ids[n:]
+			}
+		}
+
+		if dryRun {
+			fmt.Fprintf(w, "Would apply filter at %s to %d existing messages\n", f.pos, len(matched))
+			continue
+		}
+		fmt.Fprintf(w, "Applied filter at %s to %d existing messages\n", f.pos, len(matched))
+	}
+
+	return nil
+}
+
+// listAllMessages lists the IDs of all the messages matching the search query,
+// going through every page.
+func listAllMessages(b backend, q string) ([]string, error) {
+	var (
+		all       []string
+		pageToken string
+	)
+	for {
+		ids, next, err := b.ListMessages(q, pageToken)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, ids...)
+		if len(next) < 1 {
+			return all, nil
+		}
+		pageToken = next
+	}
+}
+
+// wantsApplyToExisting reports whether any of the filters are applied to
+// existing messages.
+func wantsApplyToExisting(filters []filter) bool {
+	if applyExisting {
+		return true
+	}
+	for _, f := range filters {
+		if f.ApplyToExisting {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jessfraz/gmailfilters/query"
+)
+
+func TestApplyToExisting(t *testing.T) {
+	defer func(d, a bool) { dryRun, applyExisting = d, a }(dryRun, applyExisting)
+
+	filters, err := decodeFile(writeTestFile(t, "filters.toml", `[[filter]]
+from = "notifications@github.com"
+label = "github"
+archive = true
+applyToExisting = true
+
+[[filter]]
+query = "list:coreos-dev.googlegroups.com"
+label = "Mailing Lists/coreos-dev"
+archiveUnlessToMe = true
+applyToExisting = true
+
+[[filter]]
+from = "spam@example.com"
+delete = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newMemoryBackend()
+	message := func(raw string) *query.Message {
+		msg, err := parseMessage([]byte(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Me = []string{"jess@example.com"}
+		return msg
+	}
+
+	// More messages than fit on one page of results.
+	var github []string
+	for i := 0; i < memoryPageSize+50; i++ {
+		github = append(github, m.addMessage(message(fmt.Sprintf("From: notifications@github.com\nTo: jess@example.com\nSubject: PR %d\n\nLGTM\n", i)), "INBOX", "UNREAD"))
+	}
+	trashed := m.addMessage(message("From: notifications@github.com\nTo: jess@example.com\nSubject: Old\n\nLGTM\n"), "TRASH")
+	list := m.addMessage(message("From: alex@example.com\nTo: coreos-dev@googlegroups.com\nList-Id: <coreos-dev.googlegroups.com>\nSubject: Release\n\nA new release is out.\n"), "INBOX")
+	listToMe := m.addMessage(message("From: alex@example.com\nTo: jess@example.com, coreos-dev@googlegroups.com\nList-Id: <coreos-dev.googlegroups.com>\nSubject: Question\n\nJess?\n"), "INBOX")
+	spam := m.addMessage(message("From: spam@example.com\nTo: jess@example.com\nSubject: Buy now\n\nBuy.\n"), "INBOX")
+
+	b, s := newFakeGmailBackend(t, m)
+	defer s.Close()
+
+	// A dry run only counts the messages.
+	dryRun = true
+	var buf bytes.Buffer
+	if err := applyToExisting(&buf, dryRunBackend{b}, filters, false); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("Would apply filter at %s to %d existing messages\nWould apply filter at %s to 2 existing messages\n", filters[0].pos, len(github), filters[1].pos)
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+	if diff := cmp.Diff([]string{"INBOX", "UNREAD"}, m.messageLabels(github[0])); len(diff) > 1 {
+		t.Fatalf("expected no messages to change in dry run mode, got diff: %s", diff)
+	}
+
+	dryRun = false
+	if _, err := syncFilters(b, filters); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := applyToExisting(&buf, b, filters, false); err != nil {
+		t.Fatal(err)
+	}
+	expected = fmt.Sprintf("Applied filter at %s to %d existing messages\nApplied filter at %s to 2 existing messages\n", filters[0].pos, len(github), filters[1].pos)
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	labels, err := getLabelMap(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	githubID, listID := labels.ids["github"], labels.ids["mailing lists/coreos-dev"]
+	expectedLabels := map[string][]string{
+		github[0]:             {"UNREAD", githubID},
+		github[len(github)-1]: {"UNREAD", githubID},
+		trashed:               {"TRASH"},
+		list:                  {listID},
+		listToMe:              {"INBOX", listID},
+		// The filter without applyToExisting is left alone.
+		spam: {"INBOX"},
+	}
+	for id, expected := range expectedLabels {
+		if diff := cmp.Diff(expected, m.messageLabels(id)); len(diff) > 1 {
+			t.Errorf("%s: got diff: %s", id, diff)
+		}
+	}
+
+	// All the filters are applied with --apply-existing.
+	buf.Reset()
+	if err := applyToExisting(&buf, b, filters[2:], true); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"INBOX", "TRASH"}, m.messageLabels(spam)); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestWantsApplyToExisting(t *testing.T) {
+	defer func(a bool) { applyExisting = a }(applyExisting)
+
+	filters := []filter{{From: "a@example.com", Archive: true}}
+	if wantsApplyToExisting(filters) {
+		t.Fatal("expected filters without applyToExisting not to be applied to existing messages")
+	}
+
+	filters = append(filters, filter{From: "b@example.com", Archive: true, ApplyToExisting: true})
+	if !wantsApplyToExisting(filters) {
+		t.Fatal("expected a filter with applyToExisting to be applied to existing messages")
+	}
+
+	applyExisting = true
+	if !wantsApplyToExisting(filters[:1]) {
+		t.Fatal("expected --apply-existing to apply all filters to existing messages")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const expandHelp = `Print a filter config with its includes, variables and templates expanded.`
+
+const expandLongHelp = expandHelp + `
+
+The config is printed in the format of the file passed, or the --format flag,
+so the filters that will be synced can be reviewed.`
+
+func (cmd *expandCommand) Name() string      { return "expand" }
+func (cmd *expandCommand) Args() string      { return "FILE" }
+func (cmd *expandCommand) ShortHelp() string { return expandHelp }
+func (cmd *expandCommand) LongHelp() string  { return expandLongHelp }
+func (cmd *expandCommand) Hidden() bool      { return false }
+
+func (cmd *expandCommand) Register(fs *flag.FlagSet) {}
+
+type expandCommand struct{}
+
+func (cmd *expandCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("must pass a path to a gmail filter configuration file")
+	}
+
+	return expandConfig(os.Stdout, args[0])
+}
+
+// expandConfig writes the filters of a config, with everything expanded, in
+// the format of the config.
+func expandConfig(w io.Writer, file string) error {
+	filters, err := decodeFile(file)
+	if err != nil {
+		return err
+	}
+
+	format, err := fileFormat(file)
+	if err != nil {
+		return err
+	}
+
+	skipped, err := encodeFilterfile(w, format, filterfile{Filter: filters})
+	if skipped > 0 {
+		logrus.Warnf("Skipped %d filters that could not be converted", skipped)
+	}
+	return err
+}
+
+// filterTemplate generates a filter for each row of ForEach. A ${key} in any
+// of the values of the filter is replaced with the value of key in the row.
+type filterTemplate struct {
+	filter `yaml:",inline"`
+
+	ForEach []map[string]string `toml:"forEach" yaml:"forEach" json:"forEach"`
+}
+
+// expandTemplates generates the filters of the templates. The filters point
+// at the template they came from in errors.
+func (s varScope) expandTemplates(templates []filterTemplate) ([]filter, configErrors) {
+	var (
+		filters []filter
+		errs    configErrors
+	)
+	for _, t := range templates {
+		if len(t.ForEach) == 0 {
+			errs = append(errs, &configError{pos: t.pos, msg: "filter template must have at least one forEach row"})
+			continue
+		}
+
+		// Every row usually has the same problem, so only report it once.
+		seen := map[string]bool{}
+		for _, row := range t.ForEach {
+			f, problems := s.withRow(row).expandAll(t.filter)
+			for _, problem := range problems {
+				if !seen[problem] {
+					errs = append(errs, &configError{pos: t.pos, msg: problem})
+				}
+				seen[problem] = true
+			}
+			filters = append(filters, f)
+		}
+	}
+	return filters, errs
+}
+
+// withRow returns the scope with the values of a forEach row added. The row
+// wins over variables with the same name.
+func (s varScope) withRow(row map[string]string) varScope {
+	vars := make(map[string]string, len(s.vars)+len(row))
+	for name, value := range s.vars {
+		vars[name] = value
+	}
+	for name, value := range row {
+		vars[strings.TrimSpace(name)] = value
+	}
+	return varScope{vars: vars}
+}
+
+// expandAll expands the variables in every string value of a filter.
+func (s varScope) expandAll(f filter) (filter, []string) {
+	var problems []string
+
+	v := reflect.ValueOf(&f).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("toml")
+		if len(tag) < 1 {
+			continue
+		}
+		key := strings.Split(tag, ",")[0]
+
+		expand := func(field reflect.Value) {
+			expanded, err := s.expand(field.String())
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+				return
+			}
+			field.SetString(expanded)
+		}
+
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.String:
+			expand(field)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String && !field.IsNil():
+			// Copy the slice so the rows do not share it.
+			values := reflect.MakeSlice(field.Type(), field.Len(), field.Len())
+			reflect.Copy(values, field)
+			for j := 0; j < values.Len(); j++ {
+				expand(values.Index(j))
+			}
+			field.Set(values)
+		}
+	}
+
+	return f, problems
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFilterTemplates(t *testing.T) {
+	testCases := map[string]string{
+		"filters.toml": `
+[vars]
+prefix = "Mailing Lists"
+
+[[filter]]
+from = "boss@example.com"
+star = true
+
+[[filterTemplate]]
+query = "list:${list}"
+labels = ["${prefix}/${label}"]
+archiveUnlessToMe = true
+
+[[filterTemplate.forEach]]
+list = "coreos-dev@googlegroups.com"
+label = "coreos-dev"
+
+[[filterTemplate.forEach]]
+list = "xdg-app@lists.freedesktop.org"
+label = "xdg-apps"
+`,
+		"filters.yaml": `
+vars:
+  prefix: Mailing Lists
+filter:
+  - from: boss@example.com
+    star: true
+filterTemplate:
+  - query: list:${list}
+    labels: ["${prefix}/${label}"]
+    archiveUnlessToMe: true
+    forEach:
+      - {list: coreos-dev@googlegroups.com, label: coreos-dev}
+      - {list: xdg-app@lists.freedesktop.org, label: xdg-apps}
+`,
+	}
+
+	expected := []filter{
+		{From: "boss@example.com", Star: true},
+		{Query: "list:coreos-dev@googlegroups.com", Labels: []string{"Mailing Lists/coreos-dev"}, ArchiveUnlessToMe: true},
+		{Query: "list:xdg-app@lists.freedesktop.org", Labels: []string{"Mailing Lists/xdg-apps"}, ArchiveUnlessToMe: true},
+	}
+
+	for name, content := range testCases {
+		t.Run(name, func(t *testing.T) {
+			filters, err := decodeFile(writeTestFile(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range filters {
+				filters[i].pos = position{}
+			}
+
+			if diff := cmp.Diff(expected, filters, cmp.AllowUnexported(filter{}, position{})); len(diff) > 1 {
+				t.Fatalf("got diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestFilterTemplateErrors(t *testing.T) {
+	file := writeTestFile(t, "filters.toml", `
+[[filterTemplate]]
+name = "lists"
+query = "list:${list}"
+label = "${lable}"
+archve = true
+
+[[filterTemplate.forEach]]
+list = "coreos-dev@googlegroups.com"
+label = "coreos-dev"
+
+[[filterTemplate.forEach]]
+list = "xdg-app@lists.freedesktop.org"
+label = "xdg-apps"
+
+[[filterTemplate]]
+query = "list:${list}"
+`)
+
+	_, err := decodeFile(file)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	expected := []string{
+		file + `:2: label: undefined variable "lable", did you mean "label"?`,
+		file + `:2: there is already a filter named "lists"`,
+		file + `:6: unknown filter template key "archve", did you mean "archive"?`,
+		file + `:16: filter template must have at least one forEach row`,
+	}
+	if diff := cmp.Diff(expected, strings.Split(err.Error(), "\n")); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestExpandConfig(t *testing.T) {
+	dir := writeTestDir(t, map[string]string{
+		"filters.yaml": `include: [lists.toml]
+filter:
+  - query: from:${boss}
+    star: true
+vars:
+  boss: boss@example.com
+`,
+		"lists.toml": `
+[[filterTemplate]]
+query = "list:${list}"
+label = "Mailing Lists/${list}"
+forEach = [{list = "coreos-dev@googlegroups.com"}]
+`,
+	})
+
+	var buf bytes.Buffer
+	if err := expandConfig(&buf, filepath.Join(dir, "filters.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `filter:
+  - query: list:coreos-dev@googlegroups.com
+    label: Mailing Lists/coreos-dev@googlegroups.com
+  - query: from:boss@example.com
+    star: true
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
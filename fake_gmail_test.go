@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// newFakeGmailServer starts a fake Gmail REST server that serves the filters
+// labels and messages of the memory backend passed.
+func newFakeGmailServer(m *memoryBackend) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gmail/v1/users/", func(w http.ResponseWriter, r *http.Request) {
+		// Strip the user from the path.
+		path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/"), "/", 2)
+		if len(path) != 2 || path[0] != gmailUser {
+			fakeGmailError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		switch resource, id := splitID(path[1]); {
+		case resource == "settings/filters" && id == "" && r.Method == http.MethodGet:
+			filters, err := m.ListFilters()
+			fakeGmailResponse(w, &gmail.ListFiltersResponse{Filter: filters}, err)
+		case resource == "settings/filters" && id == "" && r.Method == http.MethodPost:
+			var f gmail.Filter
+			if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+				fakeGmailError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			created, err := m.CreateFilter(&f)
+			fakeGmailResponse(w, created, err)
+		case resource == "settings/filters" && id != "" && r.Method == http.MethodDelete:
+			fakeGmailResponse(w, nil, m.DeleteFilter(id))
+		case resource == "labels" && id == "" && r.Method == http.MethodGet:
+			labels, err := m.ListLabels()
+			fakeGmailResponse(w, &gmail.ListLabelsResponse{Labels: labels}, err)
+		case resource == "labels" && id == "" && r.Method == http.MethodPost:
+			var l gmail.Label
+			if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+				fakeGmailError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			created, err := m.CreateLabel(&l)
+			fakeGmailResponse(w, created, err)
+		case resource == "labels" && id != "" && r.Method == http.MethodDelete:
+			fakeGmailResponse(w, nil, m.DeleteLabel(id))
+		case resource == "messages" && id == "" && r.Method == http.MethodGet:
+			ids, next, err := m.ListMessages(r.URL.Query().Get("q"), r.URL.Query().Get("pageToken"))
+			resp := &gmail.ListMessagesResponse{NextPageToken: next}
+			for _, id := range ids {
+				resp.Messages = append(resp.Messages, &gmail.Message{Id: id})
+			}
+			fakeGmailResponse(w, resp, err)
+		case resource == "messages" && id == "batchModify" && r.Method == http.MethodPost:
+			var req gmail.BatchModifyMessagesRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				fakeGmailError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if len(req.Ids) > batchModifyLimit {
+				fakeGmailError(w, http.StatusBadRequest, "too many message ids")
+				return
+			}
+			fakeGmailResponse(w, nil, m.BatchModifyMessages(req.Ids, req.AddLabelIds, req.RemoveLabelIds))
+		default:
+			fakeGmailError(w, http.StatusNotFound, "not found")
+		}
+	})
+
+	return httptest.NewServer(mux)
+}
+
+// newFakeGmailBackend returns a Gmail API backend talking to a fake Gmail REST
+// server for the memory backend passed. The server must be closed by the
+// caller.
+func newFakeGmailBackend(t *testing.T, m *memoryBackend) (*gmailBackend, *httptest.Server) {
+	s := newFakeGmailServer(m)
+
+	svc, err := gmail.New(s.Client())
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	svc.BasePath = s.URL + "/gmail/v1/users/"
+
+	return newGmailBackend(svc, gmailUser), s
+}
+
+// splitID splits the trailing ID from a resource path like labels/Label_1.
+func splitID(path string) (string, string) {
+	for _, resource := range []string{"settings/filters", "labels", "messages"} {
+		if path == resource {
+			return resource, ""
+		}
+		if strings.HasPrefix(path, resource+"/") {
+			return resource, strings.TrimPrefix(path, resource+"/")
+		}
+	}
+	return path, ""
+}
+
+func fakeGmailResponse(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		fakeGmailError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func fakeGmailError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+		},
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSieveServer is an in-process stand-in for a ManageSieve server that
+// keeps its scripts in memory.
+type fakeSieveServer struct {
+	addr string
+	l    net.Listener
+
+	mu      sync.Mutex
+	scripts map[string]string
+	active  string
+	// puts counts the scripts uploaded.
+	puts int
+	// reject makes the server refuse scripts containing it.
+	reject string
+}
+
+// newFakeSieveServer starts a fake ManageSieve server that accepts the user
+// and password passed. It must be closed by the caller.
+func newFakeSieveServer(t *testing.T, user, password string) *fakeSieveServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSieveServer{addr: l.Addr().String(), l: l, scripts: map[string]string{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, user, password)
+		}
+	}()
+	return s
+}
+
+// Close stops the server from accepting connections.
+func (s *fakeSieveServer) Close() error {
+	return s.l.Close()
+}
+
+func (s *fakeSieveServer) serve(conn net.Conn, user, password string) {
+	defer conn.Close()
+
+	fmt.Fprint(conn, "\"IMPLEMENTATION\" \"fake\"\r\n\"SASL\" \"PLAIN\"\r\n\"SIEVE\" \"fileinto imap4flags\"\r\n\"VERSION\" \"1.0\"\r\nOK \"ready\"\r\n")
+
+	r := bufio.NewReader(conn)
+	authenticated := false
+	for {
+		words, err := readSieveLine(r)
+		if err != nil {
+			return
+		}
+		if len(words) < 1 {
+			continue
+		}
+		arg := func(i int) string {
+			if i < len(words) {
+				return words[i]
+			}
+			return ""
+		}
+
+		s.mu.Lock()
+		switch command := strings.ToUpper(words[0]); {
+		case command == "LOGOUT":
+			fmt.Fprint(conn, "OK \"bye\"\r\n")
+			s.mu.Unlock()
+			return
+		case command == "AUTHENTICATE":
+			plain, _ := base64.StdEncoding.DecodeString(arg(2))
+			if arg(1) != "PLAIN" || string(plain) != "\x00"+user+"\x00"+password {
+				fmt.Fprint(conn, "NO \"Authentication failed\"\r\n")
+				break
+			}
+			authenticated = true
+			fmt.Fprint(conn, "OK\r\n")
+		case !authenticated:
+			fmt.Fprint(conn, "NO \"Not authenticated\"\r\n")
+		case command == "LISTSCRIPTS":
+			var names []string
+			for name := range s.scripts {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if name == s.active {
+					fmt.Fprintf(conn, "%q ACTIVE\r\n", name)
+					continue
+				}
+				fmt.Fprintf(conn, "%q\r\n", name)
+			}
+			fmt.Fprint(conn, "OK\r\n")
+		case command == "GETSCRIPT":
+			script, ok := s.scripts[arg(1)]
+			if !ok {
+				fmt.Fprint(conn, "NO (NONEXISTENT) \"There is no such script\"\r\n")
+				break
+			}
+			fmt.Fprintf(conn, "{%d}\r\n%s\r\nOK\r\n", len(script), script)
+		case command == "CHECKSCRIPT" || command == "PUTSCRIPT":
+			script := arg(len(words) - 1)
+			if err := s.check(script); err != nil {
+				fmt.Fprintf(conn, "NO %q\r\n", err.Error())
+				break
+			}
+			if command == "PUTSCRIPT" {
+				s.scripts[arg(1)] = script
+				s.puts++
+			}
+			fmt.Fprint(conn, "OK\r\n")
+		case command == "SETACTIVE":
+			if _, ok := s.scripts[arg(1)]; !ok {
+				fmt.Fprint(conn, "NO (NONEXISTENT) \"There is no such script\"\r\n")
+				break
+			}
+			s.active = arg(1)
+			fmt.Fprint(conn, "OK\r\n")
+		default:
+			fmt.Fprint(conn, "NO \"Unknown command\"\r\n")
+		}
+		s.mu.Unlock()
+	}
+}
+
+// check parses the script like a server would before running it.
+func (s *fakeSieveServer) check(script string) error {
+	if len(s.reject) > 0 && strings.Contains(script, s.reject) {
+		return fmt.Errorf("%s is not allowed", s.reject)
+	}
+	p, err := newSieveParser(script)
+	if err != nil {
+		return err
+	}
+	_, err = p.commands(false)
+	return err
+}
@@ -1,34 +1,81 @@
 package main
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
 
-	"github.com/BurntSushi/toml"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/api/gmail/v1"
 )
 
 // filterfile defines a set of filter objects.
 type filterfile struct {
-	Filter []filter
+	// Vars and Fragments hold named values that can be used in queries as
+	// ${name}. They are the same thing under two names.
+	Vars      map[string]string `toml:"vars,omitempty" yaml:"vars,omitempty" json:"vars,omitempty"`
+	Fragments map[string]string `toml:"fragments,omitempty" yaml:"fragments,omitempty" json:"fragments,omitempty"`
+
+	// FilterTemplate holds templates that generate filters.
+	FilterTemplate []filterTemplate `toml:"filterTemplate,omitempty" yaml:"filterTemplate,omitempty" json:"filterTemplate,omitempty"`
+
+	// Include holds the paths or glob patterns of other config files to load
+	// the filters of, relative to this file.
+	Include []string `toml:"include,omitempty" yaml:"include,omitempty" json:"include,omitempty"`
+
+	Filter []filter `toml:"filter" yaml:"filter" json:"filter"`
+}
+
+// categories maps the category names for a filter to their Gmail label IDs.
+var categories = map[string]string{
+	"personal":   "CATEGORY_PERSONAL",
+	"social":     "CATEGORY_SOCIAL",
+	"promotions": "CATEGORY_PROMOTIONS",
+	"updates":    "CATEGORY_UPDATES",
+	"forums":     "CATEGORY_FORUMS",
 }
 
 // filter defines a filter object.
 type filter struct {
-	Query             string
-	QueryOr           []string
-	Archive           bool
-	Read              bool
-	Delete            bool
-	ToMe              bool
-	ArchiveUnlessToMe bool
-	Label             string
-	ForwardTo         string
+	// Name identifies the filter, so an overlay in fleet mode can replace
+	// the baseline filter with the same name.
+	Name string `toml:"name,omitempty" yaml:"name,omitempty" json:"name,omitempty"`
+
+	Query             string   `toml:"query,omitempty" yaml:"query,omitempty" json:"query,omitempty"`
+	QueryOr           []string `toml:"queryOr,omitempty" yaml:"queryOr,omitempty" json:"queryOr,omitempty"`
+	From              string   `toml:"from,omitempty" yaml:"from,omitempty" json:"from,omitempty"`
+	To                string   `toml:"to,omitempty" yaml:"to,omitempty" json:"to,omitempty"`
+	Subject           string   `toml:"subject,omitempty" yaml:"subject,omitempty" json:"subject,omitempty"`
+	NegatedQuery      string   `toml:"negatedQuery,omitempty" yaml:"negatedQuery,omitempty" json:"negatedQuery,omitempty"`
+	HasAttachment     bool     `toml:"hasAttachment,omitempty" yaml:"hasAttachment,omitempty" json:"hasAttachment,omitempty"`
+	ExcludeChats      bool     `toml:"excludeChats,omitempty" yaml:"excludeChats,omitempty" json:"excludeChats,omitempty"`
+	SizeGreaterThan   string   `toml:"sizeGreaterThan,omitempty" yaml:"sizeGreaterThan,omitempty" json:"sizeGreaterThan,omitempty"`
+	SizeLessThan      string   `toml:"sizeLessThan,omitempty" yaml:"sizeLessThan,omitempty" json:"sizeLessThan,omitempty"`
+	Archive           bool     `toml:"archive,omitempty" yaml:"archive,omitempty" json:"archive,omitempty"`
+	Read              bool     `toml:"read,omitempty" yaml:"read,omitempty" json:"read,omitempty"`
+	Delete            bool     `toml:"delete,omitempty" yaml:"delete,omitempty" json:"delete,omitempty"`
+	Star              bool     `toml:"star,omitempty" yaml:"star,omitempty" json:"star,omitempty"`
+	Important         bool     `toml:"important,omitempty" yaml:"important,omitempty" json:"important,omitempty"`
+	NeverImportant    bool     `toml:"neverImportant,omitempty" yaml:"neverImportant,omitempty" json:"neverImportant,omitempty"`
+	NeverSpam         bool     `toml:"neverSpam,omitempty" yaml:"neverSpam,omitempty" json:"neverSpam,omitempty"`
+	Category          string   `toml:"category,omitempty" yaml:"category,omitempty" json:"category,omitempty"`
+	ToMe              bool     `toml:"toMe,omitempty" yaml:"toMe,omitempty" json:"toMe,omitempty"`
+	ArchiveUnlessToMe bool     `toml:"archiveUnlessToMe,omitempty" yaml:"archiveUnlessToMe,omitempty" json:"archiveUnlessToMe,omitempty"`
+	Label             string   `toml:"label,omitempty" yaml:"label,omitempty" json:"label,omitempty"`
+	Labels            []string `toml:"labels,omitempty" yaml:"labels,omitempty" json:"labels,omitempty"`
+	RemoveLabels      []string `toml:"removeLabels,omitempty" yaml:"removeLabels,omitempty" json:"removeLabels,omitempty"`
+	ForwardTo         string   `toml:"forwardTo,omitempty" yaml:"forwardTo,omitempty" json:"forwardTo,omitempty"`
+
+	// ApplyToExisting applies the filter to the messages already in the
+	// account when it is synced.
+	ApplyToExisting bool `toml:"applyToExisting,omitempty" yaml:"applyToExisting,omitempty" json:"applyToExisting,omitempty"`
+
+	// pos is where the filter was defined.
+	pos position
 }
 
 func (f filter) toGmailFilters(labels *labelMap) ([]gmail.Filter, error) {
@@ -42,8 +89,9 @@ func (f filter) toGmailFilters(labels *labelMap) ([]gmail.Filter, error) {
 		f.Query = strings.Join(f.QueryOr, " OR ")
 	}
 
-	if len(f.Query) < 1 {
-		return nil, errors.New("query or queryOr cannot be empty")
+	criteria, err := f.criteria()
+	if err != nil {
+		return nil, err
 	}
 
 	action := gmail.FilterAction{
@@ -59,28 +107,67 @@ func (f filter) toGmailFilters(labels *labelMap) ([]gmail.Filter, error) {
 		action.AddLabelIds = append(action.AddLabelIds, labelID)
 	}
 
+	for _, label := range f.Labels {
+		// Create the label if it does not exist.
+		labelID, err := labels.createLabelIfDoesNotExist(label)
+		if err != nil {
+			return nil, err
+		}
+		action.AddLabelIds = appendUnique(action.AddLabelIds, labelID)
+	}
+
 	action.RemoveLabelIds = []string{}
+	for _, label := range f.RemoveLabels {
+		// Create the label if it does not exist.
+		labelID, err := labels.createLabelIfDoesNotExist(label)
+		if err != nil {
+			return nil, err
+		}
+		action.RemoveLabelIds = appendUnique(action.RemoveLabelIds, labelID)
+	}
+
 	if f.Archive && !f.ArchiveUnlessToMe {
-		action.RemoveLabelIds = append(action.RemoveLabelIds, "INBOX")
+		action.RemoveLabelIds = appendUnique(action.RemoveLabelIds, "INBOX")
 	}
 
 	if f.Read {
-		action.RemoveLabelIds = append(action.RemoveLabelIds, "UNREAD")
+		action.RemoveLabelIds = appendUnique(action.RemoveLabelIds, "UNREAD")
 	}
 
 	if f.Delete {
-		action.AddLabelIds = append(action.AddLabelIds, "TRASH")
+		action.AddLabelIds = appendUnique(action.AddLabelIds, "TRASH")
 	}
 
-	if len(f.ForwardTo) > 0 {
-		action.Forward = f.ForwardTo
+	if f.Star {
+		action.AddLabelIds = appendUnique(action.AddLabelIds, "STARRED")
 	}
 
-	criteria := gmail.FilterCriteria{
-		Query: f.Query,
+	if f.Important && f.NeverImportant {
+		return nil, errors.New("cannot have both important and neverImportant")
 	}
-	if f.ToMe || f.ArchiveUnlessToMe {
-		criteria.To = "me"
+
+	if f.Important {
+		action.AddLabelIds = appendUnique(action.AddLabelIds, "IMPORTANT")
+	}
+
+	if f.NeverImportant {
+		action.RemoveLabelIds = appendUnique(action.RemoveLabelIds, "IMPORTANT")
+	}
+
+	if f.NeverSpam {
+		action.RemoveLabelIds = appendUnique(action.RemoveLabelIds, "SPAM")
+	}
+
+	if len(f.Category) > 0 {
+		category, ok := categories[strings.ToLower(f.Category)]
+		if !ok {
+			return nil, fmt.Errorf("invalid category %q, must be one of personal, social, promotions, updates or forums", f.Category)
+		}
+		action.AddLabelIds = appendUnique(action.AddLabelIds, category)
+	}
+
+	if len(f.ForwardTo) > 0 {
+		action.Forward = f.ForwardTo
 	}
 
 	filter := gmail.Filter{
@@ -95,16 +182,15 @@ func (f filter) toGmailFilters(labels *labelMap) ([]gmail.Filter, error) {
 	if f.ArchiveUnlessToMe {
 		// Copy the filter.
 		archiveIfNotToMeFilter := filter
-		archiveIfNotToMeFilter.Criteria = &gmail.FilterCriteria{
-			Query:        f.Query,
-			To:           "",
-			NegatedQuery: "to:me",
-		}
+		archiveCriteria := criteria
+		archiveCriteria.To = ""
+		archiveCriteria.NegatedQuery = "to:me"
+		archiveIfNotToMeFilter.Criteria = &archiveCriteria
 
 		// Copy the action.
 		archiveAction := action
 		// Archive it.
-		archiveAction.RemoveLabelIds = append(action.RemoveLabelIds, "INBOX")
+		archiveAction.RemoveLabelIds = append(append([]string{}, action.RemoveLabelIds...), "INBOX")
 		archiveIfNotToMeFilter.Action = &archiveAction
 
 		// Append the extra filter.
@@ -114,170 +200,366 @@ func (f filter) toGmailFilters(labels *labelMap) ([]gmail.Filter, error) {
 	return filters, nil
 }
 
-func (f filter) addFilter(labels *labelMap) error {
-	// Convert the filter into a gmail filter.
-	filters, err := f.toGmailFilters(labels)
-	if err != nil {
-		return err
+// criteria returns the Gmail filter criteria for the filter. The query
+// must already have the queryOr joined into it.
+func (f filter) criteria() (gmail.FilterCriteria, error) {
+	criteria := gmail.FilterCriteria{
+		Query:         f.Query,
+		From:          f.From,
+		To:            f.To,
+		Subject:       f.Subject,
+		NegatedQuery:  f.NegatedQuery,
+		HasAttachment: f.HasAttachment,
+		ExcludeChats:  f.ExcludeChats,
 	}
 
-	// Add the filters.
-	for _, fltr := range filters {
-		logrus.WithFields(logrus.Fields{
-			"action":   fmt.Sprintf("%#v", fltr.Action),
-			"criteria": fmt.Sprintf("%#v", fltr.Criteria),
-		}).Debug("adding Gmail filter")
-		if _, err := api.Users.Settings.Filters.Create(gmailUser, &fltr).Do(); err != nil {
-			return fmt.Errorf("creating filter [%#v] failed: %v", fltr, err)
+	if f.ToMe || f.ArchiveUnlessToMe {
+		if len(f.To) > 0 {
+			return criteria, errors.New("cannot have both to and toMe or archiveUnlessToMe")
 		}
+		criteria.To = "me"
 	}
 
-	return nil
+	if f.ArchiveUnlessToMe && len(f.NegatedQuery) > 0 {
+		return criteria, errors.New("cannot have both a negatedQuery and archiveUnlessToMe")
+	}
+
+	if len(f.SizeGreaterThan) > 0 && len(f.SizeLessThan) > 0 {
+		return criteria, errors.New("cannot have both sizeGreaterThan and sizeLessThan")
+	}
+	if len(f.SizeGreaterThan) > 0 {
+		size, err := parseSize(f.SizeGreaterThan)
+		if err != nil {
+			return criteria, err
+		}
+		criteria.Size = size
+		criteria.SizeComparison = "larger"
+	}
+	if len(f.SizeLessThan) > 0 {
+		size, err := parseSize(f.SizeLessThan)
+		if err != nil {
+			return criteria, err
+		}
+		criteria.Size = size
+		criteria.SizeComparison = "smaller"
+	}
+
+	if len(criteria.Query) < 1 && len(criteria.From) < 1 && len(criteria.To) < 1 &&
+		len(criteria.Subject) < 1 && len(criteria.NegatedQuery) < 1 &&
+		!criteria.HasAttachment && criteria.Size < 1 {
+		return criteria, errors.New("query, queryOr, from, to, subject, negatedQuery, hasAttachment or a size must be set")
+	}
+
+	return criteria, nil
 }
 
-func decodeFile(file string) ([]filter, error) {
+// decodeConfigFile decodes a single filter config file. It does not load the
+// files it includes or expand variables, and the filters still need to be
+// validated.
+func decodeConfigFile(file string) (configFile, error) {
 	b, err := ioutil.ReadFile(file)
 	if err != nil {
-		return nil, fmt.Errorf("reading filter file %s failed: %v", file, err)
+		return configFile{}, fmt.Errorf("reading filter file %s failed: %v", file, err)
+	}
+
+	format, err := fileFormat(file)
+	if err != nil {
+		return configFile{}, err
+	}
+
+	ff, layout, undecoded, err := decodeFilterfile(file, format, b)
+	if err != nil {
+		return configFile{}, fmt.Errorf("decoding %s in %s failed: %v", format, file, err)
 	}
 
-	var ff filterfile
-	if _, err := toml.Decode(string(b), &ff); err != nil {
-		return nil, fmt.Errorf("decoding toml failed: %v", err)
+	// Remember where each filter came from so we can point at it in errors.
+	for i := range ff.Filter {
+		ff.Filter[i].pos = position{file: file, line: layout.blockLine("filter", i)}
+	}
+	for i := range ff.FilterTemplate {
+		ff.FilterTemplate[i].pos = position{file: file, line: layout.blockLine("filterTemplate", i)}
 	}
 
-	return ff.Filter, nil
+	return configFile{name: file, ff: ff, layout: layout, undecoded: undecoded}, nil
 }
 
-func exportExistingFilters(file string) error {
+func exportExistingFilters(b backend, file string) error {
 	fmt.Print("exporting existing filters...\n")
 
-	filters, err := getExistingFilters()
+	filters, err := getExistingFilters(b)
 	if err != nil {
 		return fmt.Errorf("error downloading existing filters: %v", err)
 	}
 
-	var ff filterfile
-	for _, f := range filters {
-		// We could get duplicate filters, so it's best to remove them.
-		existingFilter := findExistingFilter(ff.Filter, f.Query)
-
-		// Since we can't return nil on a struct or compary it to something empty,
-		// check if the query exists. If not then consider it not found.
-		if existingFilter.Query != "" {
-			// Duplicate filters can only exist if the ArchiveUnlessToMe is set.
-			// So we can simply reset everything and just set the ArchiveUnlessToMe flag to true.
-			existingFilter.Archive = false
-			existingFilter.Delete = false
-			existingFilter.ToMe = false
-			existingFilter.ArchiveUnlessToMe = true
-		} else {
-			ff.Filter = append(ff.Filter, f)
-		}
+	ff := filterfile{
+		Filter: mergeExportedFilters(filters),
 	}
 
 	return writeFiltersToFile(ff, file)
 }
 
-func deleteExistingFilters() error {
-	// Get current filters for the user.
-	l, err := api.Users.Settings.Filters.List(gmailUser).Do()
-	if err != nil {
-		return fmt.Errorf("listing filters failed: %v", err)
-	}
+// mergeExportedFilters merges the pairs of filters created for an
+// archiveUnlessToMe filter back into a single filter and removes any exact
+// duplicates. Everything else is kept as is so no filter is lost.
+func mergeExportedFilters(filters []filter) []filter {
+	merged := []filter{}
+	used := make([]bool, len(filters))
+
+	for i, f := range filters {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+
+		// Look for the other half of an archiveUnlessToMe pair.
+		if f.ToMe && !f.Archive {
+			for j := i + 1; j < len(filters); j++ {
+				if !used[j] && isArchiveUnlessToMePair(f, filters[j]) {
+					used[j] = true
+					f.ToMe = false
+					f.ArchiveUnlessToMe = true
+					break
+				}
+			}
+		}
 
-	// Iterate over the filters.
-	for _, f := range l.Filter {
-		// Delete the filter.
-		if err := api.Users.Settings.Filters.Delete(gmailUser, f.Id).Do(); err != nil {
-			return fmt.Errorf("deleting filter id %s failed: %v", f.Id, err)
+		// We could get duplicate filters, so it's best to remove them.
+		duplicate := false
+		for _, m := range merged {
+			// Where the filters came from does not matter.
+			m.pos = f.pos
+			if reflect.DeepEqual(m, f) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			merged = append(merged, f)
 		}
 	}
 
-	return nil
+	return merged
+}
+
+// isArchiveUnlessToMePair returns true if the filters are the two filters
+// toGmailFilters creates for an archiveUnlessToMe filter. The first one
+// matches mail to me and the second archives the same mail when it is not
+// to me.
+func isArchiveUnlessToMePair(toMe, notToMe filter) bool {
+	if !notToMe.Archive || notToMe.NegatedQuery != "to:me" || notToMe.ToMe {
+		return false
+	}
+
+	// Everything else should be the same.
+	toMe.ToMe = false
+	toMe.pos = notToMe.pos
+	notToMe.Archive = false
+	notToMe.NegatedQuery = ""
+	return reflect.DeepEqual(toMe, notToMe)
 }
 
-func getExistingFilters() ([]filter, error) {
-	gmailFilters, err := api.Users.Settings.Filters.List(gmailUser).Do()
+func getExistingFilters(b backend) ([]filter, error) {
+	gmailFilters, err := b.ListFilters()
 	if err != nil {
 		return nil, err
 	}
 
-	labels, err := getLabelMapOnID()
+	labels, err := getLabelMapOnID(b)
 	if err != nil {
 		return nil, err
 	}
 
 	var filters []filter
+	for _, gmailFilter := range gmailFilters {
+		filters = append(filters, fromGmailFilter(gmailFilter, labels))
+	}
 
-	for _, gmailFilter := range gmailFilters.Filter {
-		var f filter
+	return filters, nil
+}
 
-		if gmailFilter.Criteria.Query > "" {
-			f.Query = gmailFilter.Criteria.Query
+// fromGmailFilter converts a Gmail filter into a filter. The labels map the
+// label IDs to their names.
+func fromGmailFilter(gmailFilter *gmail.Filter, labels map[string]string) filter {
+	var f filter
 
-			if gmailFilter.Criteria.To == "me" {
-				f.ToMe = true
-			}
+	// Either can be missing from what the API returns.
+	c := gmailFilter.Criteria
+	if c == nil {
+		c = &gmail.FilterCriteria{}
+	}
+	a := gmailFilter.Action
+	if a == nil {
+		a = &gmail.FilterAction{}
+	}
 
-			if len(gmailFilter.Action.AddLabelIds) > 0 {
-				labelID := gmailFilter.Action.AddLabelIds[0]
-				if labelID == "TRASH" {
-					f.Delete = true
-				} else {
-					labelName, ok := labels[labelID]
-					if ok {
-						f.Label = labelName
-					}
-				}
-			}
+	f.Query = c.Query
+	f.From = c.From
+	f.Subject = c.Subject
+	f.NegatedQuery = c.NegatedQuery
+	f.HasAttachment = c.HasAttachment
+	f.ExcludeChats = c.ExcludeChats
+
+	if c.To == "me" {
+		f.ToMe = true
+	} else {
+		f.To = c.To
+	}
 
-			if len(gmailFilter.Action.RemoveLabelIds) > 0 {
-				for _, labelID := range gmailFilter.Action.RemoveLabelIds {
-					if labelID == "UNREAD" {
-						f.Read = true
-					} else if labelID == "INBOX" {
-						if gmailFilter.Criteria.NegatedQuery == "to:me" {
-							f.ArchiveUnlessToMe = true
-						} else {
-							f.Archive = true
-						}
-					}
-				}
-			}
+	if c.Size > 0 {
+		switch c.SizeComparison {
+		case "larger":
+			f.SizeGreaterThan = formatSize(c.Size)
+		case "smaller":
+			f.SizeLessThan = formatSize(c.Size)
 		}
+	}
 
-		filters = append(filters, f)
+	var addLabels []string
+	for _, labelID := range a.AddLabelIds {
+		switch category := categoryName(labelID); {
+		case labelID == "TRASH":
+			f.Delete = true
+		case labelID == "STARRED":
+			f.Star = true
+		case labelID == "IMPORTANT":
+			f.Important = true
+		case len(category) > 0 && len(f.Category) < 1:
+			f.Category = category
+		case len(category) > 0:
+			// A filter only has one category, and exporting the ID as a
+			// user label would create a new label on import.
+			logrus.Warnf("Filter already has category %s, dropping category %s", f.Category, category)
+		default:
+			addLabels = append(addLabels, labelName(labels, labelID))
+		}
+	}
+	// Keep the single label form for the common case.
+	if len(addLabels) == 1 {
+		f.Label = addLabels[0]
+	} else {
+		f.Labels = addLabels
 	}
 
-	return filters, nil
+	for _, labelID := range a.RemoveLabelIds {
+		if labelID == "UNREAD" {
+			f.Read = true
+		} else if labelID == "INBOX" {
+			// The archiveUnlessToMe filters are merged back together
+			// when exporting.
+			f.Archive = true
+		} else if labelID == "IMPORTANT" {
+			f.NeverImportant = true
+		} else if labelID == "SPAM" {
+			f.NeverSpam = true
+		} else {
+			f.RemoveLabels = append(f.RemoveLabels, labelName(labels, labelID))
+		}
+	}
+
+	f.ForwardTo = a.Forward
+
+	return f
 }
 
 func writeFiltersToFile(ff filterfile, file string) error {
+	format, err := fileFormat(file)
+	if err != nil {
+		return err
+	}
+
 	exportFile, err := os.Create(file)
 	if err != nil {
 		return fmt.Errorf("error exporting filters: %v", err)
 	}
+	defer exportFile.Close()
 
-	writer := bufio.NewWriter(exportFile)
-	encoder := toml.NewEncoder(writer)
-	encoder.Indent = ""
+	skipped, err := encodeFilterfile(exportFile, format, ff)
+	if err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
 
-	if err := encoder.Encode(ff); err != nil {
+	if err := exportFile.Close(); err != nil {
 		return fmt.Errorf("error writing file: %v", err)
 	}
 
+	if skipped > 0 {
+		fmt.Printf("Exported %d filters, skipped %d that could not be converted\n", len(ff.Filter)-skipped, skipped)
+		return nil
+	}
 	fmt.Printf("Exported %d filters\n", len(ff.Filter))
 
 	return nil
 }
 
-func findExistingFilter(filters []filter, query string) filter {
-	for _, f := range filters {
-		if f.Query == query {
-			return f
+// categoryName returns the category name for a label ID or an empty string
+// if the label is not a category.
+func categoryName(id string) string {
+	for name, categoryID := range categories {
+		if categoryID == id {
+			return name
+		}
+	}
+	return ""
+}
+
+// labelName returns the name of the label with the ID passed. If we do not
+// know the label we use the ID so it is not lost.
+func labelName(labels map[string]string, id string) string {
+	if name, ok := labels[id]; ok {
+		return name
+	}
+	logrus.Warnf("Could not find the name of label %s, using its ID", id)
+	return id
+}
+
+// appendUnique appends s to the slice if it is not already in it.
+func appendUnique(slice []string, s string) []string {
+	for _, v := range slice {
+		if v == s {
+			return slice
+		}
+	}
+	return append(slice, s)
+}
+
+// sizeUnits are the units a size can be given in, largest first.
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a size like 5MB, 100KB or 2048 into bytes.
+func parseSize(s string) (int64, error) {
+	size := strings.ToUpper(strings.TrimSpace(s))
+
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSpace(strings.TrimSuffix(size, unit.suffix))
+			multiplier = unit.bytes
+			break
 		}
 	}
 
-	return filter{}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid size %q, must be a positive number of bytes with an optional KB, MB or GB unit", s)
+	}
+
+	return n * multiplier, nil
+}
+
+// formatSize formats bytes as a size in the largest unit that fits exactly.
+func formatSize(bytes int64) string {
+	for _, unit := range sizeUnits {
+		if bytes%unit.bytes == 0 {
+			return fmt.Sprintf("%d%s", bytes/unit.bytes, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", bytes)
 }
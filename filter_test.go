@@ -10,8 +10,9 @@ import (
 
 func TestFilterToGmailFilters(t *testing.T) {
 	testCases := map[string]struct {
-		orig     filter
-		expected []gmail.Filter
+		orig        filter
+		expected    []gmail.Filter
+		expectedErr string
 	}{
 		"archive unless to me": {
 			orig: filter{
@@ -106,16 +107,155 @@ func TestFilterToGmailFilters(t *testing.T) {
 				},
 			},
 		},
+		"archive and read with removeLabels": {
+			orig: filter{
+				From:         "notifications@github.com",
+				RemoveLabels: []string{"INBOX", "UNREAD"},
+				Archive:      true,
+				Read:         true,
+			},
+			expected: []gmail.Filter{
+				{
+					Action: &gmail.FilterAction{
+						AddLabelIds:    []string{},
+						RemoveLabelIds: []string{"INBOX", "UNREAD"},
+					},
+					Criteria: &gmail.FilterCriteria{
+						From: "notifications@github.com",
+					},
+				},
+			},
+		},
+		"multiple labels": {
+			orig: filter{
+				Query:        "from:notifications@github.com",
+				Label:        "Mailing Lists/coreos-dev",
+				Labels:       []string{"Mailing Lists/xdg-apps", "Mailing Lists/coreos-dev"},
+				RemoveLabels: []string{"github"},
+				Read:         true,
+			},
+			expected: []gmail.Filter{
+				{
+					Action: &gmail.FilterAction{
+						AddLabelIds:    []string{"1", "2"},
+						RemoveLabelIds: []string{"3", "UNREAD"},
+					},
+					Criteria: &gmail.FilterCriteria{
+						Query: "from:notifications@github.com",
+					},
+				},
+			},
+		},
+		"star, important, never spam and category": {
+			orig: filter{
+				From:      "boss@example.com",
+				Star:      true,
+				Important: true,
+				NeverSpam: true,
+				Category:  "Updates",
+			},
+			expected: []gmail.Filter{
+				{
+					Action: &gmail.FilterAction{
+						AddLabelIds:    []string{"STARRED", "IMPORTANT", "CATEGORY_UPDATES"},
+						RemoveLabelIds: []string{"SPAM"},
+					},
+					Criteria: &gmail.FilterCriteria{
+						From: "boss@example.com",
+					},
+				},
+			},
+		},
+		"never important": {
+			orig: filter{
+				From:           "newsletter@example.com",
+				NeverImportant: true,
+				Category:       "promotions",
+			},
+			expected: []gmail.Filter{
+				{
+					Action: &gmail.FilterAction{
+						AddLabelIds:    []string{"CATEGORY_PROMOTIONS"},
+						RemoveLabelIds: []string{"IMPORTANT"},
+					},
+					Criteria: &gmail.FilterCriteria{
+						From: "newsletter@example.com",
+					},
+				},
+			},
+		},
+		"invalid category": {
+			orig: filter{
+				From:     "newsletter@example.com",
+				Category: "junk",
+			},
+			expectedErr: `invalid category "junk", must be one of personal, social, promotions, updates or forums`,
+		},
+		"criteria fields": {
+			orig: filter{
+				From:            "builds@travis-ci.org",
+				Subject:         "Build failed",
+				NegatedQuery:    "passed",
+				HasAttachment:   true,
+				ExcludeChats:    true,
+				SizeGreaterThan: "5MB",
+				Label:           "Mailing Lists/coreos-dev",
+			},
+			expected: []gmail.Filter{
+				{
+					Action: &gmail.FilterAction{
+						AddLabelIds:    []string{"1"},
+						RemoveLabelIds: []string{},
+					},
+					Criteria: &gmail.FilterCriteria{
+						From:           "builds@travis-ci.org",
+						Subject:        "Build failed",
+						NegatedQuery:   "passed",
+						HasAttachment:  true,
+						ExcludeChats:   true,
+						Size:           5242880,
+						SizeComparison: "larger",
+					},
+				},
+			},
+		},
+		"to and archive unless to me": {
+			orig: filter{
+				To:                "team@example.com",
+				Subject:           "standup",
+				ArchiveUnlessToMe: true,
+			},
+			expectedErr: "cannot have both to and toMe or archiveUnlessToMe",
+		},
+		"no criteria": {
+			orig: filter{
+				Label:   "Mailing Lists/coreos-dev",
+				Archive: true,
+			},
+			expectedErr: "query, queryOr, from, to, subject, negatedQuery, hasAttachment or a size must be set",
+		},
 	}
 
 	labels := &labelMap{
-		strings.ToLower("Mailing Lists/coreos-dev"): "1",
-		strings.ToLower("Mailing Lists/xdg-apps"):   "2",
+		b: newMemoryBackend(),
+		ids: map[string]string{
+			strings.ToLower("Mailing Lists/coreos-dev"): "1",
+			strings.ToLower("Mailing Lists/xdg-apps"):   "2",
+			"github": "3",
+			"inbox":  "INBOX",
+			"unread": "UNREAD",
+		},
 	}
 
 	for name, tc := range testCases {
 		t.Run(name, func(t *testing.T) {
 			filters, err := tc.orig.toGmailFilters(labels)
+			if len(tc.expectedErr) > 0 {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Fatalf("expected error %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -126,3 +266,76 @@ func TestFilterToGmailFilters(t *testing.T) {
 		})
 	}
 }
+
+func TestFromGmailFilter(t *testing.T) {
+	testCases := map[string]struct {
+		gmailFilter *gmail.Filter
+		expected    filter
+	}{
+		"no criteria": {
+			gmailFilter: &gmail.Filter{Action: &gmail.FilterAction{AddLabelIds: []string{"STARRED"}}},
+			expected:    filter{Star: true},
+		},
+		"no action": {
+			gmailFilter: &gmail.Filter{Criteria: &gmail.FilterCriteria{From: "jess@example.com"}},
+			expected:    filter{From: "jess@example.com"},
+		},
+		"two categories": {
+			gmailFilter: &gmail.Filter{
+				Criteria: &gmail.FilterCriteria{From: "news@example.com"},
+				Action:   &gmail.FilterAction{AddLabelIds: []string{"CATEGORY_UPDATES", "CATEGORY_PROMOTIONS", "Label_1"}},
+			},
+			// The second category is not exported as a user label.
+			expected: filter{From: "news@example.com", Category: "updates", Label: "news"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			f := fromGmailFilter(tc.gmailFilter, map[string]string{"Label_1": "news"})
+			if diff := cmp.Diff(tc.expected, f, cmp.AllowUnexported(filter{}, position{})); len(diff) > 1 {
+				t.Fatalf("got diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	testCases := map[string]struct {
+		size     string
+		expected int64
+	}{
+		"bytes":      {size: "2048", expected: 2048},
+		"bytes unit": {size: "2048B", expected: 2048},
+		"kilobytes":  {size: "100KB", expected: 102400},
+		"megabytes":  {size: "5 mb", expected: 5242880},
+		"gigabytes":  {size: "1GB", expected: 1073741824},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			size, err := parseSize(tc.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != tc.expected {
+				t.Fatalf("expected %d, got %d", tc.expected, size)
+			}
+
+			// Make sure we can go back and forth.
+			again, err := parseSize(formatSize(size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != size {
+				t.Fatalf("expected %d after formatting as %s, got %d", size, formatSize(size), again)
+			}
+		})
+	}
+
+	for _, invalid := range []string{"", "MB", "-5MB", "5TB", "five"} {
+		if _, err := parseSize(invalid); err == nil {
+			t.Fatalf("expected an error parsing %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/toml"
+)
+
+const fleetHelp = `Sync a baseline filter set plus per-user overlays to many mailboxes.`
+
+const fleetLongHelp = fleetHelp + `
+
+The manifest lists the baseline config files and the overlay config files of
+each user:
+
+  baseline = ["baseline.toml"]
+
+  [users]
+  "alice@corp.com" = ["alice.toml"]
+  "bob@corp.com" = []
+
+Overlay filters replace the baseline filters with the same name and the
+others are added. The credential file must be a service account key with
+domain-wide delegation. Filters are only synced with the Gmail API, so the
+sieve backend and applying filters to existing messages are not supported.`
+
+func (cmd *fleetCommand) Name() string      { return "fleet" }
+func (cmd *fleetCommand) Args() string      { return "MANIFEST" }
+func (cmd *fleetCommand) ShortHelp() string { return fleetHelp }
+func (cmd *fleetCommand) LongHelp() string  { return fleetLongHelp }
+func (cmd *fleetCommand) Hidden() bool      { return false }
+
+func (cmd *fleetCommand) Register(fs *flag.FlagSet) {
+	fs.IntVar(&cmd.workers, "workers", 4, "number of mailboxes to sync at once")
+}
+
+type fleetCommand struct {
+	workers int
+}
+
+func (cmd *fleetCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("must pass a path to a fleet manifest")
+	}
+	if cmd.workers < 1 {
+		return errors.New("workers must be at least 1")
+	}
+
+	m, err := decodeManifest(args[0])
+	if err != nil {
+		return err
+	}
+
+	// Load every config before touching any mailbox, so a bad overlay does
+	// not leave the fleet half synced.
+	filters, err := m.userFilters()
+	if err != nil {
+		return err
+	}
+	if err := checkFleetOptions(filters); err != nil {
+		return err
+	}
+
+	results := syncFleet(ctx, filters, cmd.workers, func(ctx context.Context, user string) (backend, error) {
+		api, err := newAPIBackend(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		return api, nil
+	})
+
+	printFleetSummary(os.Stdout, results)
+
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("syncing filters failed for %d of %d users", failed, len(results))
+	}
+
+	return nil
+}
+
+// checkFleetOptions returns an error for the options fleet mode does not
+// support, rather than silently ignoring them. Fleet mode only syncs filters
+// with the Gmail API.
+func checkFleetOptions(users []userFilters) error {
+	sieve, err := parseBackend(backendFlag)
+	if err != nil {
+		return err
+	}
+	if sieve != nil {
+		return errors.New("fleet only works with the gmail backend")
+	}
+	if applyExisting {
+		return errors.New("--apply-existing does not work with fleet")
+	}
+
+	for _, u := range users {
+		for _, f := range u.filters {
+			if f.ApplyToExisting {
+				return fmt.Errorf("%s: applyToExisting does not work with fleet", f.pos)
+			}
+		}
+	}
+	return nil
+}
+
+// fleetManifest maps users to the config files of their filters.
+type fleetManifest struct {
+	// Baseline holds the config files every user gets.
+	Baseline []string `toml:"baseline"`
+	// Users maps each user to the config files of their overlays.
+	Users map[string][]string `toml:"users"`
+}
+
+// decodeManifest decodes a fleet manifest. Paths in it are relative to the
+// directory of the manifest.
+func decodeManifest(file string) (fleetManifest, error) {
+	var m fleetManifest
+	md, err := toml.DecodeFile(file, &m)
+	if err != nil {
+		return m, fmt.Errorf("decoding manifest %s failed: %v", file, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return m, fmt.Errorf("%s: unknown key %q", file, undecoded[0].String())
+	}
+	if len(m.Users) == 0 {
+		return m, fmt.Errorf("%s: the manifest has no users", file)
+	}
+
+	dir := filepath.Dir(file)
+	resolve := func(paths []string) {
+		for i, p := range paths {
+			if !filepath.IsAbs(p) {
+				paths[i] = filepath.Join(dir, p)
+			}
+		}
+	}
+	resolve(m.Baseline)
+	for _, overlays := range m.Users {
+		resolve(overlays)
+	}
+
+	return m, nil
+}
+
+// userFilters decodes the baseline and overlays of every user and merges
+// them. The users are returned sorted.
+func (m fleetManifest) userFilters() ([]userFilters, error) {
+	decoded := map[string][]filter{}
+	decode := func(files []string) ([][]filter, error) {
+		var sets [][]filter
+		for _, file := range files {
+			if _, ok := decoded[file]; !ok {
+				filters, err := decodeFile(file)
+				if err != nil {
+					return nil, err
+				}
+				decoded[file] = filters
+			}
+			sets = append(sets, decoded[file])
+		}
+		return sets, nil
+	}
+
+	baseline, err := decode(m.Baseline)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]string, 0, len(m.Users))
+	for user := range m.Users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	var all []userFilters
+	for _, user := range users {
+		overlays, err := decode(m.Users[user])
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, userFilters{
+			user:    user,
+			filters: mergeFilters(append(append([][]filter{}, baseline...), overlays...)...),
+		})
+	}
+
+	return all, nil
+}
+
+// userFilters are the filters for a user's mailbox.
+type userFilters struct {
+	user    string
+	filters []filter
+}
+
+// mergeFilters merges sets of filters in order. A filter replaces an earlier
+// filter with the same name, keeping its place, and the other filters are
+// added to the end.
+func mergeFilters(sets ...[]filter) []filter {
+	var merged []filter
+	named := map[string]int{}
+	for _, set := range sets {
+		for _, f := range set {
+			if i, ok := named[f.Name]; ok && len(f.Name) > 0 {
+				merged[i] = f
+				continue
+			}
+			if len(f.Name) > 0 {
+				named[f.Name] = len(merged)
+			}
+			merged = append(merged, f)
+		}
+	}
+	return merged
+}
+
+// fleetResult is the result of syncing a user's mailbox.
+type fleetResult struct {
+	user string
+	// synced is set once we got to the mailbox, the diff then holds what
+	// was done even if syncing failed part of the way.
+	synced bool
+	diff   filterDiff
+	err    error
+}
+
+// syncFleet syncs the filters of each user with at most workers mailboxes at
+// once. In dry run mode the changes are only planned. The results are in the
+// same order as the users.
+func syncFleet(ctx context.Context, users []userFilters, workers int, newBackend func(context.Context, string) (backend, error)) []fleetResult {
+	results := make([]fleetResult, len(users))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = syncUser(ctx, users[i], newBackend)
+			}
+		}()
+	}
+
+	for i := range users {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// syncUser syncs the filters of a single user in the fleet.
+func syncUser(ctx context.Context, u userFilters, newBackend func(context.Context, string) (backend, error)) fleetResult {
+	result := fleetResult{user: u.user}
+	if err := ctx.Err(); err != nil {
+		result.err = err
+		return result
+	}
+
+	b, err := newBackend(ctx, u.user)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	result.synced = true
+	if dryRun {
+		result.diff, result.err = planSync(dryRunBackend{b}, u.filters)
+	} else {
+		result.diff, result.err = syncFilters(b, u.filters)
+	}
+	return result
+}
+
+// printFleetSummary prints what was done to each mailbox in the fleet.
+func printFleetSummary(w io.Writer, results []fleetResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tCREATED\tDELETED\tUNCHANGED\tERROR")
+	for _, r := range results {
+		var errText string
+		if r.err != nil {
+			errText = strings.Replace(r.err.Error(), "\n", "; ", -1)
+		}
+		if !r.synced {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t%s\n", r.user, errText)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\n", r.user, len(r.diff.create), len(r.diff.delete), r.diff.unchanged, errText)
+	}
+	tw.Flush()
+}
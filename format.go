@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/google/go-jsonnet"
+	"gopkg.in/yaml.v3"
+)
+
+// formats are the filter config formats we support.
+var formats = []string{"toml", "yaml", "json", "jsonnet", "xml", "sieve"}
+
+// fileFormat returns the format of a filter config file. The --format flag
+// wins, then the extension of the file decides.
+func fileFormat(file string) (string, error) {
+	if len(format) > 0 {
+		return checkFormat(format)
+	}
+	return extensionFormat(file), nil
+}
+
+// checkFormat returns an error if the format is not one we support.
+func checkFormat(name string) (string, error) {
+	for _, f := range formats {
+		if f == name {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown format %q, must be one of %s", name, strings.Join(formats, ", "))
+}
+
+// extensionFormat returns the format for the extension of a file. Anything
+// we do not know is TOML.
+func extensionFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	case ".jsonnet", ".libsonnet":
+		return "jsonnet"
+	case ".xml":
+		// The mailFilters.xml the Gmail settings export.
+		return "xml"
+	case ".sieve", ".siv":
+		return "sieve"
+	}
+	return "toml"
+}
+
+// decodeFilterfile decodes a filter config in the format passed. It returns
+// the lines the filters and keys are on and the keys it did not know.
+func decodeFilterfile(file, format string, data []byte) (filterfile, configLayout, []toml.Key, error) {
+	var ff filterfile
+
+	switch format {
+	case "xml":
+		ff, layout, err := decodeMailFilters(file, data)
+		return ff, layout, nil, err
+	case "sieve":
+		ff, layout, err := decodeSieve(file, data)
+		return ff, layout, nil, err
+	case "yaml":
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return ff, configLayout{}, nil, err
+		}
+		if err := doc.Decode(&ff); err != nil {
+			return ff, configLayout{}, nil, err
+		}
+		layout := scanYAMLLayout(&doc)
+		return ff, layout, layout.unknownKeys(false), nil
+	case "json", "jsonnet":
+		if format == "jsonnet" {
+			vm := jsonnet.MakeVM()
+			vm.Importer(&jsonnet.FileImporter{})
+			out, err := vm.EvaluateSnippet(file, string(data))
+			if err != nil {
+				return ff, configLayout{}, nil, err
+			}
+			data = []byte(out)
+		}
+
+		if err := json.Unmarshal(data, &ff); err != nil {
+			return ff, configLayout{}, nil, err
+		}
+		layout, err := scanJSONLayout(data)
+		if err != nil {
+			return ff, configLayout{}, nil, err
+		}
+		if format == "jsonnet" {
+			// The lines of the generated JSON mean nothing to the user.
+			layout = layout.withoutLines()
+		}
+		return ff, layout, layout.unknownKeys(true), nil
+	}
+
+	md, err := toml.Decode(string(data), &ff)
+	if err != nil {
+		return ff, configLayout{}, nil, err
+	}
+	return ff, scanTOMLLayout(string(data)), md.Undecoded(), nil
+}
+
+// encodeFilterfile encodes a filter config in the format passed. Jsonnet is a
+// superset of JSON, so it is written as JSON. It returns the number of filters
+// skipped since they could not be converted, which only happens for Sieve.
+func encodeFilterfile(w io.Writer, format string, ff filterfile) (int, error) {
+	switch format {
+	case "xml":
+		return 0, encodeMailFilters(w, ff)
+	case "sieve":
+		return encodeSieve(w, ff, nil)
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(ff); err != nil {
+			return 0, err
+		}
+		return 0, encoder.Close()
+	case "json", "jsonnet":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return 0, encoder.Encode(ff)
+	}
+
+	// The encoder buffers and flushes the writer itself.
+	encoder := toml.NewEncoder(w)
+	encoder.Indent = ""
+	return 0, encoder.Encode(ff)
+}
+
+// scanYAMLLayout finds the lines the filters and keys of a YAML document are
+// defined on.
+func scanYAMLLayout(doc *yaml.Node) configLayout {
+	layout := newConfigLayout()
+	if len(doc.Content) < 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return layout
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		layout.top[key.Value] = key.Line
+		table, ok := blockTable(key.Value, false)
+		if !ok || value.Kind != yaml.SequenceNode {
+			continue
+		}
+
+		for _, item := range value.Content {
+			block := layout.addBlock(table, item.Line)
+			for j := 0; j+1 < len(item.Content); j += 2 {
+				block.keys[item.Content[j].Value] = item.Content[j].Line
+			}
+		}
+	}
+
+	return layout
+}
+
+// scanJSONLayout finds the lines the filters and keys of a JSON document are
+// defined on. The document has already been decoded, so it is valid JSON.
+func scanJSONLayout(data []byte) (configLayout, error) {
+	layout := newConfigLayout()
+	s := &jsonScanner{data: data, line: 1}
+
+	if tok, _, err := s.next(); err != nil || tok != json.Delim('{') {
+		return layout, err
+	}
+	for s.more() {
+		key, keyLine, err := s.next()
+		if err != nil {
+			return layout, err
+		}
+		name, _ := key.(string)
+		layout.top[name] = keyLine
+
+		value, _, err := s.next()
+		if err != nil {
+			return layout, err
+		}
+		table, ok := blockTable(name, true)
+		if !ok || value != json.Delim('[') {
+			if err := s.skip(value); err != nil {
+				return layout, err
+			}
+			continue
+		}
+
+		for s.more() {
+			item, itemLine, err := s.next()
+			if err != nil {
+				return layout, err
+			}
+			if item != json.Delim('{') {
+				if err := s.skip(item); err != nil {
+					return layout, err
+				}
+				continue
+			}
+
+			block := layout.addBlock(table, itemLine)
+			for s.more() {
+				k, kLine, err := s.next()
+				if err != nil {
+					return layout, err
+				}
+				v, _, err := s.next()
+				if err != nil {
+					return layout, err
+				}
+				if err := s.skip(v); err != nil {
+					return layout, err
+				}
+				if key, ok := k.(string); ok {
+					block.keys[key] = kLine
+				}
+			}
+			if _, _, err := s.next(); err != nil {
+				return layout, err
+			}
+		}
+		if _, _, err := s.next(); err != nil {
+			return layout, err
+		}
+	}
+
+	return layout, nil
+}
+
+// jsonScanner reads the tokens of a JSON document and the lines they start
+// on.
+type jsonScanner struct {
+	data []byte
+	pos  int
+	line int
+}
+
+// skipSpace skips the whitespace and separators before the next token.
+func (s *jsonScanner) skipSpace() {
+	for s.pos < len(s.data) && strings.IndexByte(" \t\r\n,:", s.data[s.pos]) >= 0 {
+		if s.data[s.pos] == '\n' {
+			s.line++
+		}
+		s.pos++
+	}
+}
+
+// more reports whether the current object or array has another element.
+func (s *jsonScanner) more() bool {
+	s.skipSpace()
+	return s.pos < len(s.data) && s.data[s.pos] != '}' && s.data[s.pos] != ']'
+}
+
+// next returns the next token and the line it starts on. Delimiters are
+// returned as a json.Delim, strings as a string, and numbers, booleans and
+// null as their raw text in a json.Number.
+func (s *jsonScanner) next() (json.Token, int, error) {
+	s.skipSpace()
+	if s.pos >= len(s.data) {
+		return nil, s.line, io.ErrUnexpectedEOF
+	}
+
+	line := s.line
+	switch c := s.data[s.pos]; c {
+	case '{', '[', '}', ']':
+		s.pos++
+		return json.Delim(c), line, nil
+	case '"':
+		end := s.pos + 1
+		for end < len(s.data) && s.data[end] != '"' {
+			if s.data[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s.data) {
+			return nil, line, io.ErrUnexpectedEOF
+		}
+		var str string
+		if err := json.Unmarshal(s.data[s.pos:end+1], &str); err != nil {
+			return nil, line, err
+		}
+		s.pos = end + 1
+		return str, line, nil
+	default:
+		start := s.pos
+		for s.pos < len(s.data) && strings.IndexByte(" \t\r\n,:]}", s.data[s.pos]) < 0 {
+			s.pos++
+		}
+		return json.Number(s.data[start:s.pos]), line, nil
+	}
+}
+
+// skip skips over a value whose first token has been read.
+func (s *jsonScanner) skip(tok json.Token) error {
+	if d, ok := tok.(json.Delim); !ok || (d != '{' && d != '[') {
+		return nil
+	}
+	for depth := 1; depth > 0; {
+		tok, _, err := s.next()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	return nil
+}
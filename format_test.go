@@ -0,0 +1,168 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDecodeFormats(t *testing.T) {
+	expected := []filter{
+		{Name: "activity", Query: "to:your_activity@noreply.github.com", Archive: true, Read: true},
+		{QueryOr: []string{"to:plans@tripit.com", "to:receipts@expensify.com"}, Labels: []string{"travel", "receipts"}},
+	}
+
+	testCases := map[string]string{
+		"filters.toml": `
+[[filter]]
+name = "activity"
+query = "to:your_activity@noreply.github.com"
+archive = true
+read = true
+
+[[filter]]
+queryOr = ["to:plans@tripit.com", "to:receipts@expensify.com"]
+labels = ["travel", "receipts"]
+`,
+		"filters.yaml": `
+filter:
+  - name: activity
+    query: to:your_activity@noreply.github.com
+    archive: true
+    read: true
+  - queryOr:
+      - to:plans@tripit.com
+      - to:receipts@expensify.com
+    labels: [travel, receipts]
+`,
+		"filters.json": `{
+  "filter": [
+    {"name": "activity", "query": "to:your_activity@noreply.github.com", "archive": true, "read": true},
+    {"queryOr": ["to:plans@tripit.com", "to:receipts@expensify.com"], "labels": ["travel", "receipts"]}
+  ]
+}`,
+		"filters.jsonnet": `
+local archived(name, query) = {name: name, query: query, archive: true, read: true};
+{
+  filter: [
+    archived("activity", "to:your_activity@noreply.github.com"),
+    {queryOr: ["to:%s" % addr for addr in ["plans@tripit.com", "receipts@expensify.com"]], labels: ["travel", "receipts"]},
+  ],
+}`,
+	}
+
+	for name, content := range testCases {
+		t.Run(name, func(t *testing.T) {
+			filters, err := decodeFile(writeTestFile(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range filters {
+				filters[i].pos = position{}
+			}
+
+			if diff := cmp.Diff(expected, filters, cmp.AllowUnexported(filter{}, position{})); len(diff) > 1 {
+				t.Fatalf("got diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDecodeFormatErrors(t *testing.T) {
+	testCases := map[string]struct {
+		content  string
+		expected []string
+	}{
+		"filters.yaml": {
+			content: `fliter: 1
+filter:
+  - query: to:your_activity@noreply.github.com
+    archve: true
+  - from: notifications@github.com
+    delete: true
+    archive: true
+`,
+			expected: []string{
+				`:1: unknown key "fliter"`,
+				`:4: unknown filter key "archve", did you mean "archive"?`,
+				`:5: cannot have both delete and archive or archiveUnlessToMe`,
+			},
+		},
+		"filters.json": {
+			content: `{
+  "fliter": {"a": [1, 2]},
+  "filter": [
+    {
+      "query": "to:your_activity@noreply.github.com",
+      "archve": true
+    },
+    {
+      "from": "notifications@github.com",
+      "delete": true,
+      "archive": true
+    }
+  ]
+}`,
+			expected: []string{
+				`:2: unknown key "fliter"`,
+				`:6: unknown filter key "archve", did you mean "archive"?`,
+				`:8: cannot have both delete and archive or archiveUnlessToMe`,
+			},
+		},
+		"filters.jsonnet": {
+			content: `{filter: [{from: "notifications@github.com", delete: true, archive: true}]}`,
+			expected: []string{
+				`: cannot have both delete and archive or archiveUnlessToMe`,
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			file := writeTestFile(t, name, tc.content)
+			_, err := decodeFile(file)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			expected := make([]string, 0, len(tc.expected))
+			for _, e := range tc.expected {
+				expected = append(expected, file+e)
+			}
+			if diff := cmp.Diff(expected, strings.Split(err.Error(), "\n")); len(diff) > 1 {
+				t.Fatalf("got diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	ff := filterfile{
+		Filter: []filter{
+			{Name: "activity", Query: "to:your_activity@noreply.github.com", Archive: true, Read: true},
+			{From: "notifications@github.com", Labels: []string{"github", "github/mentions"}, SizeGreaterThan: "1MB"},
+		},
+	}
+
+	for _, name := range []string{"exported.toml", "exported.yml", "exported.json", "exported.jsonnet"} {
+		t.Run(name, func(t *testing.T) {
+			file := writeTestFile(t, name, "")
+			if err := writeFiltersToFile(ff, file); err != nil {
+				t.Fatal(err)
+			}
+
+			filters, err := decodeFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range filters {
+				filters[i].pos = position{}
+			}
+
+			if diff := cmp.Diff(ff.Filter, filters, cmp.AllowUnexported(filter{}, position{})); len(diff) > 1 {
+				t.Fatalf("got diff: %s", diff)
+			}
+		})
+	}
+}
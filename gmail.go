@@ -1,79 +1,288 @@
 package main
 
 import (
+	"bufio"
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 )
 
+// authorize runs the interactive flow to get a new token. It is a variable so
+// tests can replace it.
+var authorize = func(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+	return getTokenFromWeb(ctx, config, os.Stdin, os.Stdout)
+}
+
 // getClient retrieves a token, saves the token, then returns the generated client.
-func getClient(ctx context.Context, tokenFile string, config *oauth2.Config) (*http.Client, error) {
-	// Try reading the token from the file.
-	tok, err := tokenFromFile(tokenFile)
+func getClient(ctx context.Context, store tokenStore, account string, config *oauth2.Config) (*http.Client, error) {
+	ts, err := getTokenSource(ctx, store, account, config)
 	if err != nil {
-		logrus.Warnf("Getting token from file failed: %v", err)
+		return nil, err
+	}
+
+	return oauth2.NewClient(ctx, ts), nil
+}
+
+// getTokenSource returns a token source for the account's token in the store
+// that saves every refreshed token back to the store. The token is refreshed
+// up front so a revoked token is found before any changes are made, in which
+// case it is deleted and we authorize again.
+func getTokenSource(ctx context.Context, store tokenStore, account string, config *oauth2.Config) (oauth2.TokenSource, error) {
+	// Try reading the token from the store.
+	tok, err := store.Get(account)
+	if os.IsNotExist(err) {
+		logrus.Infof("No token saved for account %s, authorizing", account)
+		tok = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("getting token for account %s failed: %v", account, err)
+	} else {
+		tok, err = refreshToken(ctx, config, tok)
+		switch {
+		case isInvalidGrant(err):
+			logrus.Warn("The saved token has been revoked or has expired, authorizing again")
+			if err := store.Delete(account); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("deleting token for account %s failed: %v", account, err)
+			}
+			tok = nil
+		case err != nil:
+			return nil, fmt.Errorf("refreshing token failed: %v", err)
+		case !hasScopes(tok, config.Scopes):
+			logrus.Warn("The saved token does not have all the scopes needed, authorizing again")
+			tok = nil
+		default:
+			if err := store.Put(account, tok); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-		// Could not get the token from the file, try reading it from the web.
-		tok, err = getTokenFromWeb(ctx, config)
+	if tok == nil {
+		// Could not get the token from the store, try reading it from the web.
+		tok, err = authorize(ctx, config)
 		if err != nil {
 			return nil, err
 		}
 
 		// Save the token from the web.
-		if err := saveToken(tokenFile, tok); err != nil {
+		if err := store.Put(account, tok); err != nil {
 			return nil, err
 		}
 	}
 
-	return config.Client(ctx, tok), nil
+	return &savingTokenSource{
+		src:     config.TokenSource(ctx, tok),
+		store:   store,
+		account: account,
+		last:    tok,
+	}, nil
+}
+
+// refreshToken gets a new access token with the refresh token of the token
+// passed. Tokens without a refresh token are returned as they are.
+func refreshToken(ctx context.Context, config *oauth2.Config, tok *oauth2.Token) (*oauth2.Token, error) {
+	if len(tok.RefreshToken) < 1 {
+		return tok, nil
+	}
+
+	expired := *tok
+	expired.Expiry = time.Now().Add(-time.Hour)
+	return config.TokenSource(ctx, &expired).Token()
 }
 
-// getTokenFromWeb requests a token from the web, then returns the retrieved token.
-func getTokenFromWeb(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
+// hasScopes reports whether the token was granted all the scopes passed.
+// Tokens that do not say which scopes they have are assumed to have them.
+func hasScopes(tok *oauth2.Token, scopes []string) bool {
+	granted, ok := tok.Extra("scope").(string)
+	if !ok || len(granted) < 1 {
+		return true
+	}
 
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		return nil, fmt.Errorf("unable to read authorization code: %v", err)
+	have := map[string]bool{}
+	for _, s := range strings.Fields(granted) {
+		have[s] = true
+	}
+	for _, s := range scopes {
+		if !have[s] {
+			return false
+		}
 	}
+	return true
+}
+
+// isInvalidGrant reports whether the error is Google telling us the refresh
+// token has been revoked or has expired.
+func isInvalidGrant(err error) bool {
+	rerr, ok := err.(*oauth2.RetrieveError)
+	return ok && strings.Contains(string(rerr.Body), "invalid_grant")
+}
+
+// savingTokenSource is a token source that saves every new token to a token
+// store.
+type savingTokenSource struct {
+	src     oauth2.TokenSource
+	store   tokenStore
+	account string
 
-	tok, err := config.Exchange(ctx, authCode)
+	mu   sync.Mutex
+	last *oauth2.Token
+}
+
+// Token returns a token from the wrapped source, saving it if it has changed.
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve token from web: %v", err)
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last == nil || tok.AccessToken != s.last.AccessToken {
+		if err := s.store.Put(s.account, tok); err != nil {
+			return nil, err
+		}
+		s.last = tok
 	}
 
 	return tok, nil
 }
 
-// tokenFromFile retrieves a token from a local file.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
+// getTokenFromWeb gets a token with the OAuth loopback flow. A temporary
+// listener on 127.0.0.1 is used as the redirect URI so the authorization code
+// is captured automatically. On headless machines the URL the browser was
+// redirected to can be pasted instead.
+func getTokenFromWeb(ctx context.Context, config *oauth2.Config, in io.Reader, out io.Writer) (*oauth2.Token, error) {
+	state, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := randomString()
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
-}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("starting listener for the oauth redirect failed: %v", err)
+	}
+	defer l.Close()
+
+	// Copy the config so we do not change the redirect URL of the one passed.
+	cfg := *config
+	cfg.RedirectURL = fmt.Sprintf("http://%s/", l.Addr())
+
+	// Use PKCE so the code is useless to anyone who intercepts it.
+	challenge := sha256.Sum256([]byte(verifier))
+	authURL := cfg.AuthCodeURL(state, oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+
+	fmt.Fprintf(out, "Go to the following link in your browser to authorize gmailfilters:\n\n%s\n\n", authURL)
+	fmt.Fprint(out, "If your browser is on another machine, paste the URL it was redirected to here: ")
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	send := func(r result) {
+		// Only the first result is used, so never block on the others.
+		select {
+		case results <- r:
+		default:
+		}
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Ignore requests like the browser asking for a favicon.
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		code, err := authCodeFromRedirect(r.URL.Query(), state)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "gmailfilters is authorized, you can close this window.")
+		}
+		send(result{code: code, err: err})
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	// Read a pasted redirect URL at the same time. Nothing is sent if the input
+	// is closed, so we keep waiting for the redirect.
+	go func() {
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if len(strings.TrimSpace(line)) < 1 && err != nil {
+			return
+		}
+
+		u, err := url.Parse(strings.TrimSpace(line))
+		if err != nil {
+			send(result{err: fmt.Errorf("parsing redirect URL failed: %v", err)})
+			return
+		}
+		code, err := authCodeFromRedirect(u.Query(), state)
+		send(result{code: code, err: err})
+	}()
 
-// saveToken saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) error {
-	logrus.Infof("Saving credential file to: %s", path)
+	var r result
+	select {
+	case r = <-results:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	fmt.Fprintln(out)
 
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	tok, err := cfg.Exchange(ctx, r.code, oauth2.SetAuthURLParam("code_verifier", verifier))
 	if err != nil {
-		return fmt.Errorf("unable to cache oauth token: %v", err)
+		return nil, fmt.Errorf("unable to retrieve token from web: %v", err)
+	}
+
+	return tok, nil
+}
+
+// authCodeFromRedirect returns the authorization code from the query of the
+// oauth redirect after checking its state.
+func authCodeFromRedirect(q url.Values, state string) (string, error) {
+	if e := q.Get("error"); len(e) > 0 {
+		return "", fmt.Errorf("authorization failed: %s", e)
 	}
-	defer f.Close()
+	if q.Get("state") != state {
+		return "", errors.New("authorization failed: the state does not match, try again")
+	}
+	code := q.Get("code")
+	if len(code) < 1 {
+		return "", errors.New("authorization failed: no authorization code in the redirect")
+	}
+	return code, nil
+}
 
-	return json.NewEncoder(f).Encode(token)
+// randomString returns a random URL safe string for states and PKCE
+// verifiers.
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating random string failed: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
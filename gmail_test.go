@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestGetTokenFromWeb(t *testing.T) {
+	testCases := map[string]struct {
+		// finish completes the flow like a browser or user would, with the
+		// redirect URL for the auth URL.
+		finish      func(t *testing.T, redirect string, paste io.Writer)
+		expectedErr string
+	}{
+		"loopback redirect": {
+			finish: func(t *testing.T, redirect string, paste io.Writer) {
+				resp, err := http.Get(redirect)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("expected status 200 from the redirect, got %d", resp.StatusCode)
+				}
+			},
+		},
+		"pasted redirect": {
+			finish: func(t *testing.T, redirect string, paste io.Writer) {
+				fmt.Fprintln(paste, redirect)
+			},
+		},
+		"state mismatch": {
+			finish: func(t *testing.T, redirect string, paste io.Writer) {
+				fmt.Fprintln(paste, strings.Replace(redirect, "state=", "state=bad", 1))
+			},
+			expectedErr: "authorization failed: the state does not match, try again",
+		},
+		"access denied": {
+			finish: func(t *testing.T, redirect string, paste io.Writer) {
+				u, _ := url.Parse(redirect)
+				u.RawQuery = "error=access_denied"
+				http.Get(u.String())
+			},
+			expectedErr: "authorization failed: access_denied",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var challenge, redirectURI string
+			tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				verifier := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+				switch {
+				case r.Form.Get("code") != "the-code":
+					http.Error(w, "bad code", http.StatusBadRequest)
+				case base64.RawURLEncoding.EncodeToString(verifier[:]) != challenge:
+					http.Error(w, "bad code verifier", http.StatusBadRequest)
+				case r.Form.Get("redirect_uri") != redirectURI:
+					http.Error(w, "bad redirect uri", http.StatusBadRequest)
+				default:
+					w.Header().Set("Content-Type", "application/json")
+					json.NewEncoder(w).Encode(map[string]string{
+						"access_token":  "access",
+						"refresh_token": "refresh",
+						"token_type":    "Bearer",
+					})
+				}
+			}))
+			defer tokenServer.Close()
+
+			config := &oauth2.Config{
+				ClientID:     "id",
+				ClientSecret: "secret",
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  "https://accounts.example.com/auth",
+					TokenURL: tokenServer.URL,
+				},
+			}
+
+			inR, inW := io.Pipe()
+			outR, outW := io.Pipe()
+			defer inW.Close()
+			defer outW.Close()
+
+			go func() {
+				s := bufio.NewScanner(outR)
+				for s.Scan() {
+					if !strings.HasPrefix(s.Text(), config.Endpoint.AuthURL) {
+						continue
+					}
+
+					u, err := url.Parse(s.Text())
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					q := u.Query()
+					if q.Get("code_challenge_method") != "S256" {
+						t.Errorf("expected a S256 code challenge, got %q", q.Get("code_challenge_method"))
+					}
+					challenge, redirectURI = q.Get("code_challenge"), q.Get("redirect_uri")
+
+					go tc.finish(t, redirectURI+"?state="+url.QueryEscape(q.Get("state"))+"&code=the-code", inW)
+				}
+				io.Copy(ioutil.Discard, outR)
+			}()
+
+			tok, err := getTokenFromWeb(context.Background(), config, inR, outW)
+			if len(tc.expectedErr) > 0 {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Fatalf("expected error %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tok.AccessToken != "access" || tok.RefreshToken != "refresh" {
+				t.Fatalf("unexpected token: %#v", tok)
+			}
+		})
+	}
+}
+
+func TestGetTokenSource(t *testing.T) {
+	testCases := map[string]struct {
+		// status and body are the response of the token endpoint to a refresh.
+		status         int
+		body           string
+		expectedToken  string
+		expectedAuthed bool
+		expectedErr    bool
+	}{
+		"refreshed token is saved": {
+			status:        http.StatusOK,
+			body:          `{"access_token":"refreshed","token_type":"Bearer","expires_in":3600}`,
+			expectedToken: "refreshed",
+		},
+		"revoked token authorizes again": {
+			status:         http.StatusBadRequest,
+			body:           `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`,
+			expectedToken:  "authorized",
+			expectedAuthed: true,
+		},
+		"token missing a scope authorizes again": {
+			status:         http.StatusOK,
+			body:           `{"access_token":"refreshed","token_type":"Bearer","expires_in":3600,"scope":"labels"}`,
+			expectedToken:  "authorized",
+			expectedAuthed: true,
+		},
+		"token with all the scopes is saved": {
+			status:        http.StatusOK,
+			body:          `{"access_token":"refreshed","token_type":"Bearer","expires_in":3600,"scope":"settings labels"}`,
+			expectedToken: "refreshed",
+		},
+		"other errors are returned": {
+			status:      http.StatusInternalServerError,
+			body:        `{"error":"internal_failure"}`,
+			expectedErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			}))
+			defer tokenServer.Close()
+
+			config := &oauth2.Config{
+				ClientID: "id",
+				Endpoint: oauth2.Endpoint{TokenURL: tokenServer.URL},
+				Scopes:   []string{"labels", "settings"},
+			}
+
+			authed := false
+			defer func(f func(context.Context, *oauth2.Config) (*oauth2.Token, error)) { authorize = f }(authorize)
+			authorize = func(ctx context.Context, config *oauth2.Config) (*oauth2.Token, error) {
+				authed = true
+				return &oauth2.Token{AccessToken: "authorized", RefreshToken: "new-refresh"}, nil
+			}
+
+			store := &fileTokenStore{dir: filepath.Dir(writeTestFile(t, "README", ""))}
+			if err := store.Put("me@example.com", &oauth2.Token{AccessToken: "old", RefreshToken: "refresh"}); err != nil {
+				t.Fatal(err)
+			}
+
+			ts, err := getTokenSource(context.Background(), store, "me@example.com", config)
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if authed != tc.expectedAuthed {
+				t.Fatalf("expected authorized to be %t, got %t", tc.expectedAuthed, authed)
+			}
+
+			tok, err := ts.Token()
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved, err := store.Get("me@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.AccessToken != tc.expectedToken || saved.AccessToken != tc.expectedToken {
+				t.Fatalf("expected token %q, got %q and saved %q", tc.expectedToken, tok.AccessToken, saved.AccessToken)
+			}
+			if len(saved.RefreshToken) < 1 {
+				t.Fatal("expected the refresh token to be saved")
+			}
+		})
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	var revoked string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		revoked = r.URL.Query().Get("token")
+	}))
+	defer s.Close()
+
+	defer func(u string) { revokeURL = u }(revokeURL)
+	revokeURL = s.URL
+
+	if err := revokeToken(context.Background(), &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+	if revoked != "refresh" {
+		t.Fatalf("expected the refresh token to be revoked, got %q", revoked)
+	}
+}
@@ -5,13 +5,15 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/genuinetools/pkg v0.0.0-20181022210355-2fcf164d37cb
 	github.com/google/go-cmp v0.2.0
+	github.com/google/go-jsonnet v0.16.0
 	github.com/sirupsen/logrus v1.2.0
-	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550 // indirect
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
 	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
 	golang.org/x/oauth2 v0.0.0-20181203162652-d668ce993890
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58 // indirect
 	google.golang.org/api v0.0.0-20181229000844-f26a60c56f14
 	google.golang.org/appengine v1.4.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 go 1.13
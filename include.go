@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+)
+
+// configExtensions are the extensions of the files loaded from a directory.
+// Jsonnet libraries are left out since they are only imported.
+var configExtensions = map[string]bool{
+	".toml":    true,
+	".yaml":    true,
+	".yml":     true,
+	".json":    true,
+	".jsonnet": true,
+}
+
+// decodeFile decodes the filters in a config file, or in every config file in
+// a directory, along with the files they include. Variables and templates are
+// expanded before the filters are validated.
+func decodeFile(file string) ([]filter, error) {
+	l := &configLoader{loaded: map[string]bool{}, order: map[string]int{}}
+	if err := l.load(file, position{}); err != nil {
+		return nil, err
+	}
+
+	// Variables are shared by all the files, so a file can use the
+	// variables of the files it includes and the other way around.
+	vars, errs := collectVars(l.files)
+	l.errs = append(l.errs, errs...)
+
+	var filters []filter
+	for _, f := range l.files {
+		l.errs = append(l.errs, vars.expandFilters(f.ff.Filter)...)
+
+		// The generated filters come after the filters of the file and
+		// are validated with them.
+		generated, errs := vars.expandTemplates(f.ff.FilterTemplate)
+		l.errs = append(l.errs, errs...)
+		f.ff.Filter = append(f.ff.Filter, generated...)
+
+		l.errs = append(l.errs, validateFilterfile(f.name, f.layout, f.undecoded, f.ff)...)
+		filters = append(filters, f.ff.Filter...)
+	}
+
+	// Names must be unique across all the files, so check them once
+	// everything is loaded.
+	names := map[string]bool{}
+	for _, f := range filters {
+		if len(f.Name) < 1 {
+			continue
+		}
+		if names[f.Name] {
+			l.errs = append(l.errs, &configError{pos: f.pos, msg: fmt.Sprintf("there is already a filter named %q", f.Name)})
+		}
+		names[f.Name] = true
+	}
+
+	if len(l.errs) > 0 {
+		// Keep the errors of each file together, in the order the files
+		// were loaded.
+		sort.SliceStable(l.errs, func(i, j int) bool {
+			a, b := l.errs[i].pos, l.errs[j].pos
+			if a.file != b.file {
+				return l.order[a.file] < l.order[b.file]
+			}
+			return a.line < b.line
+		})
+		return nil, l.errs
+	}
+
+	return filters, nil
+}
+
+// configFile is a decoded config file.
+type configFile struct {
+	name      string
+	ff        filterfile
+	layout    configLayout
+	undecoded []toml.Key
+}
+
+// configLoader loads config files and the files they include.
+type configLoader struct {
+	// files holds the files in the order of their filters, so included
+	// files come before the file including them.
+	files []configFile
+	errs  configErrors
+
+	// loaded holds the absolute paths of the files already loaded, so a
+	// file included twice only adds its filters once.
+	loaded map[string]bool
+	// order holds the order the files were loaded in.
+	order map[string]int
+	// stack holds the files being loaded, to find include cycles.
+	stack []string
+}
+
+// load loads the filters of a file or a directory. The position is the
+// include that asked for it, if any.
+func (l *configLoader) load(file string, from position) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		if os.IsNotExist(err) && len(from.file) > 0 {
+			l.errs = append(l.errs, &configError{pos: from, msg: fmt.Sprintf("included file %s does not exist", file)})
+			return nil
+		}
+		return fmt.Errorf("reading filter file %s failed: %v", file, err)
+	}
+	if info.IsDir() {
+		return l.loadDir(file)
+	}
+
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	for i, f := range l.stack {
+		if f == abs {
+			cycle := append(append([]string{}, l.stack[i:]...), abs)
+			l.errs = append(l.errs, &configError{pos: from, msg: fmt.Sprintf("include cycle: %s", strings.Join(cycle, " -> "))})
+			return nil
+		}
+	}
+	if l.loaded[abs] {
+		return nil
+	}
+	l.loaded[abs] = true
+	l.order[file] = len(l.order)
+
+	f, err := decodeConfigFile(file)
+	if err != nil {
+		return err
+	}
+
+	// Load the included filters before the filters of the file itself.
+	l.stack = append(l.stack, abs)
+	includePos := position{file: file, line: f.layout.top["include"]}
+	for _, include := range f.ff.Include {
+		pattern := expandPath(filepath.Dir(file), include)
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			l.errs = append(l.errs, &configError{pos: includePos, msg: fmt.Sprintf("invalid include pattern %q: %v", include, err)})
+			continue
+		}
+		if len(matches) == 0 {
+			if !hasGlobMeta(include) {
+				l.errs = append(l.errs, &configError{pos: includePos, msg: fmt.Sprintf("included file %s does not exist", pattern)})
+			} else {
+				logrus.Warnf("%s: include %q matched no files", includePos, include)
+			}
+			continue
+		}
+
+		for _, match := range matches {
+			if err := l.load(match, includePos); err != nil {
+				return err
+			}
+		}
+	}
+	l.stack = l.stack[:len(l.stack)-1]
+
+	l.files = append(l.files, f)
+	return nil
+}
+
+// loadDir loads every config file in a directory in the order of their
+// names. Hidden files and subdirectories are skipped, they can be included.
+func (l *configLoader) loadDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("reading filter directory %s failed: %v", dir, err)
+	}
+
+	// ReadDir returns the files sorted by name.
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || !configExtensions[strings.ToLower(filepath.Ext(f.Name()))] {
+			continue
+		}
+		if err := l.load(filepath.Join(dir, f.Name()), position{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasGlobMeta reports whether the path has any of the special characters of
+// a glob pattern.
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
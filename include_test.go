@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeTestDir writes the files passed to a new directory under testDir and
+// returns its path.
+func writeTestDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestDecodeFileIncludes(t *testing.T) {
+	dir := writeTestDir(t, map[string]string{
+		"a.toml": `include = ["github.toml", "lists/*.toml"]
+
+[[filter]]
+from = "a@example.com"
+`,
+		"b.yaml": `filter:
+  - from: b@example.com
+`,
+		"github.toml": `[[filter]]
+from = "notifications@github.com"
+`,
+		"lists/coreos.toml": `[[filter]]
+query = "list:coreos-dev@googlegroups.com"
+`,
+		"lists/xdg.toml": `[[filter]]
+query = "list:xdg-app@lists.freedesktop.org"
+`,
+		"lists/notes.txt": `not a config file`,
+		".hidden.toml":    `not = "loaded"`,
+		"notes.txt":       `not a config file`,
+	})
+
+	testCases := []struct {
+		file     string
+		expected []string
+	}{
+		{
+			// The included files are loaded once, before the files in
+			// the directory that were not included yet.
+			file: dir,
+			expected: []string{
+				"github.toml:1",
+				"lists/coreos.toml:1",
+				"lists/xdg.toml:1",
+				"a.toml:3",
+				"b.yaml:2",
+			},
+		},
+		{
+			file: filepath.Join(dir, "a.toml"),
+			expected: []string{
+				"github.toml:1",
+				"lists/coreos.toml:1",
+				"lists/xdg.toml:1",
+				"a.toml:3",
+			},
+		},
+		{
+			file:     filepath.Join(dir, "lists"),
+			expected: []string{"lists/coreos.toml:1", "lists/xdg.toml:1"},
+		},
+	}
+
+	for _, tc := range testCases {
+		filters, err := decodeFile(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, f := range filters {
+			rel, err := filepath.Rel(dir, f.pos.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, position{file: filepath.ToSlash(rel), line: f.pos.line}.String())
+		}
+		if diff := cmp.Diff(tc.expected, got); len(diff) > 1 {
+			t.Fatalf("%s: got diff: %s", tc.file, diff)
+		}
+	}
+}
+
+func TestDecodeFileIncludeErrors(t *testing.T) {
+	dir := writeTestDir(t, map[string]string{
+		"a.toml": `include = ["b.toml", "missing.toml", "none/*.toml"]
+
+[[filter]]
+name = "github"
+from = "notifications@github.com"
+`,
+		"b.toml": `
+include = ["c.toml"]
+
+[[filter]]
+from = "b@example.com"
+archve = true
+`,
+		"c.toml": `include = ["a.toml"]
+
+[[filter]]
+name = "github"
+from = "github@example.com"
+`,
+	})
+	a, b, c := filepath.Join(dir, "a.toml"), filepath.Join(dir, "b.toml"), filepath.Join(dir, "c.toml")
+
+	_, err := decodeFile(a)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	expected := []string{
+		a + `:1: included file ` + filepath.Join(dir, "missing.toml") + ` does not exist`,
+		a + `:3: there is already a filter named "github"`,
+		b + `:6: unknown filter key "archve", did you mean "archive"?`,
+		c + `:1: include cycle: ` + strings.Join([]string{a, b, c, a}, " -> "),
+	}
+	if diff := cmp.Diff(expected, strings.Split(err.Error(), "\n")); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
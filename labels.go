@@ -8,32 +8,43 @@ import (
 	"google.golang.org/api/gmail/v1"
 )
 
-type labelMap map[string]string
+// plannedLabelPrefix is the prefix for the placeholder IDs given to labels
+// that would be created in dry run mode.
+const plannedLabelPrefix = "planned-label:"
 
-func getLabelMap() (labelMap, error) {
+// labelMap maps the lower cased label names on an account to their IDs.
+type labelMap struct {
+	b   backend
+	ids map[string]string
+}
+
+func getLabelMap(b backend) (labelMap, error) {
 	// Get the labels for the user and map its name to its ID.
-	l, err := api.Users.Labels.List(gmailUser).Do()
+	l, err := b.ListLabels()
 	if err != nil {
-		return nil, fmt.Errorf("listing labels failed: %v", err)
+		return labelMap{}, fmt.Errorf("listing labels failed: %v", err)
 	}
 
-	labels := labelMap{}
-	for _, label := range l.Labels {
-		labels[strings.ToLower(label.Name)] = label.Id
+	labels := labelMap{
+		b:   b,
+		ids: map[string]string{},
+	}
+	for _, label := range l {
+		labels.ids[strings.ToLower(label.Name)] = label.Id
 	}
 
 	return labels, nil
 }
 
-func getLabelMapOnID() (labelMap, error) {
-	// Get the labels for the user and map its name to its ID.
-	l, err := api.Users.Labels.List(gmailUser).Do()
+func getLabelMapOnID(b backend) (map[string]string, error) {
+	// Get the labels for the user and map its ID to its name.
+	l, err := b.ListLabels()
 	if err != nil {
 		return nil, fmt.Errorf("listing labels failed: %v", err)
 	}
 
-	labels := labelMap{}
-	for _, label := range l.Labels {
+	labels := map[string]string{}
+	for _, label := range l {
 		labels[label.Id] = label.Name
 	}
 
@@ -41,25 +52,32 @@ func getLabelMapOnID() (labelMap, error) {
 }
 
 func (m *labelMap) createLabelIfDoesNotExist(name string) (string, error) {
-	// De reference the pointer so we can index.
-	labels := *m
-
 	// Try to find the label.
-	id, ok := labels[strings.ToLower(name)]
+	id, ok := m.ids[strings.ToLower(name)]
 	if ok {
 		// We found the label.
 		return id, nil
 	}
 
 	// Create the label if it does not exist.
-	label, err := api.Users.Labels.Create(gmailUser, &gmail.Label{Name: name}).Do()
+	label, err := m.b.CreateLabel(&gmail.Label{Name: name})
 	if err != nil {
 		return "", fmt.Errorf("creating label %s failed: %v", name, err)
 	}
-	logrus.Infof("Created label: %s", name)
+	if _, planned := plannedLabelName(label.Id); !planned {
+		logrus.Infof("Created label: %s", name)
+	}
 
 	// Update our label map.
-	labels[strings.ToLower(name)] = label.Id
-	m = &labels
+	m.ids[strings.ToLower(name)] = label.Id
 	return label.Id, nil
 }
+
+// plannedLabelName returns the name of a label from its placeholder ID if it
+// is a label that would be created in dry run mode.
+func plannedLabelName(id string) (string, bool) {
+	if !strings.HasPrefix(id, plannedLabelPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(id, plannedLabelPrefix), true
+}
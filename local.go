@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const applyLocalHelp = `Sort the mail in mbox files or Maildirs into Maildir folders with the filters.`
+
+const applyLocalLongHelp = applyLocalHelp + `
+
+Each message is matched against the filters with the same local approximation
+of Gmail search as the test command. It is written to a Maildir folder under
+--out for each of its labels, and to INBOX unless it is archived. Archived mail
+without a label goes to Archive and deleted mail to Trash. Read mail gets the S
+flag and starred mail the F flag. Actions that mean nothing for local mail, like
+forwarding, are reported and skipped.
+
+With the global --dry-run flag, what would happen to each message is printed
+and nothing is written.`
+
+func (cmd *applyLocalCommand) Name() string      { return "apply-local" }
+func (cmd *applyLocalCommand) Args() string      { return "FILE MAILBOX..." }
+func (cmd *applyLocalCommand) ShortHelp() string { return applyLocalHelp }
+func (cmd *applyLocalCommand) LongHelp() string  { return applyLocalLongHelp }
+func (cmd *applyLocalCommand) Hidden() bool      { return false }
+
+func (cmd *applyLocalCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.out, "out", "", "directory to write the Maildir folders to")
+	fs.StringVar(&cmd.me, "me", "", "comma separated addresses that match me in queries like to:me")
+}
+
+type applyLocalCommand struct {
+	out string
+	me  string
+}
+
+func (cmd *applyLocalCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errors.New("must pass a path to a gmail filter configuration file and at least one mbox file or Maildir")
+	}
+	if len(cmd.out) < 1 && !dryRun {
+		return errors.New("must pass the directory to write the Maildir folders to with --out")
+	}
+
+	filters, err := decodeFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	// The mailboxes are read as they are sorted, so make sure they all exist
+	// before writing anything.
+	for _, mailbox := range args[1:] {
+		if _, err := os.Stat(mailbox); err != nil {
+			return err
+		}
+	}
+
+	var me []string
+	for _, addr := range strings.Split(cmd.me, ",") {
+		if addr = strings.TrimSpace(addr); len(addr) > 0 {
+			me = append(me, addr)
+		}
+	}
+
+	return applyLocal(os.Stdout, filters, args[1:], me, cmd.out)
+}
+
+// applyLocal sorts the messages in the mailboxes into the Maildir folders
+// under out, or prints what would happen to them in dry run mode. The
+// messages are read and sorted one at a time.
+func applyLocal(w io.Writer, filters []filter, mailboxes []string, me []string, out string) error {
+	s, err := newSimulator(filters)
+	if err != nil {
+		return err
+	}
+	mw := newMaildirWriter(out)
+
+	n := 0
+	counts := map[string]int{}
+	skipped := map[string]int{}
+	sortMessage := func(m localMessage) error {
+		msg, err := parseMessage(m.raw)
+		if err != nil {
+			return fmt.Errorf("parsing message %s failed: %v", m.name, err)
+		}
+		msg.Me = me
+
+		result := s.run(msg)
+		d, err := planDelivery(result, m.flags)
+		if err != nil {
+			return fmt.Errorf("%s: %v", m.name, err)
+		}
+
+		n++
+		for _, folder := range d.folders {
+			counts[folder]++
+		}
+		for _, action := range d.skipped {
+			skipped[action]++
+		}
+
+		if dryRun {
+			printDelivery(w, m.name, result, d)
+			return nil
+		}
+		for _, folder := range d.folders {
+			if err := mw.write(folder, m, d.flags); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, mailbox := range mailboxes {
+		if err := readMailbox(mailbox, sortMessage); err != nil {
+			return err
+		}
+	}
+
+	verb := "Sorted"
+	if dryRun {
+		verb = "Would sort"
+	}
+	fmt.Fprintf(w, "%s %d messages into %d folders\n", verb, n, len(counts))
+	printCounts(w, counts)
+	if len(skipped) > 0 {
+		fmt.Fprintln(w, "Actions that cannot be applied to local mail were skipped:")
+		printCounts(w, skipped)
+	}
+
+	return nil
+}
+
+func printCounts(w io.Writer, counts map[string]int) {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-30s %d\n", name, counts[name])
+	}
+}
+
+// localMessage is a message read from an mbox file or a Maildir.
+type localMessage struct {
+	name string
+	raw  []byte
+	// flags holds the Maildir flags the message already had, like S for
+	// seen.
+	flags string
+}
+
+// localDelivery is what the filters do to a local message.
+type localDelivery struct {
+	folders []string
+	flags   string
+	// skipped holds the actions that cannot be applied to local mail.
+	skipped []string
+}
+
+// Local mail that is not in the inbox or a label still goes somewhere.
+const (
+	localInbox   = "INBOX"
+	localArchive = "Archive"
+	localTrash   = "Trash"
+)
+
+// planDelivery returns the folders and flags for a message from the actions
+// of the filters that matched it.
+func planDelivery(result simulation, flags string) (localDelivery, error) {
+	var (
+		d        localDelivery
+		labels   []string
+		archived bool
+		deleted  bool
+	)
+	for _, id := range result.action.AddLabelIds {
+		switch {
+		case id == "TRASH":
+			deleted = true
+		case id == "STARRED":
+			flags += "F"
+		case id == "IMPORTANT":
+			d.skipped = append(d.skipped, "mark as important")
+		case strings.HasPrefix(id, "CATEGORY_"):
+			d.skipped = append(d.skipped, "categorize as "+categoryName(id))
+		default:
+			name, ok := plannedLabelName(id)
+			if !ok {
+				name = labelName(result.names, id)
+			}
+			if err := checkFolderName(name); err != nil {
+				return d, err
+			}
+			labels = append(labels, name)
+		}
+	}
+	for _, id := range result.action.RemoveLabelIds {
+		switch id {
+		case "INBOX":
+			archived = true
+		case "UNREAD":
+			flags += "S"
+		case "IMPORTANT":
+			d.skipped = append(d.skipped, "never mark as important")
+		case "SPAM":
+			d.skipped = append(d.skipped, "never send to spam")
+		default:
+			// Local mail has no labels to remove.
+		}
+	}
+	if len(result.action.Forward) > 0 {
+		d.skipped = append(d.skipped, "forward to "+result.action.Forward)
+	}
+
+	switch {
+	case deleted:
+		d.folders = []string{localTrash}
+	case archived && len(labels) == 0:
+		d.folders = []string{localArchive}
+	case archived:
+		d.folders = labels
+	default:
+		d.folders = append([]string{localInbox}, labels...)
+	}
+
+	// Maildir flags are unique and in ASCII order.
+	unique := map[rune]bool{}
+	for _, f := range flags {
+		unique[f] = true
+	}
+	var sorted []string
+	for f := range unique {
+		sorted = append(sorted, string(f))
+	}
+	sort.Strings(sorted)
+	d.flags = strings.Join(sorted, "")
+
+	return d, nil
+}
+
+// checkFolderName returns an error if a label cannot be used as the path of a
+// folder under the output directory.
+func checkFolderName(label string) error {
+	for i, part := range strings.Split(label, "/") {
+		switch {
+		case part == "", part == ".", part == "..", strings.ContainsRune(part, os.PathSeparator):
+			return fmt.Errorf("label %q cannot be used as a folder", label)
+		case i > 0 && (part == "cur" || part == "new" || part == "tmp"):
+			// Nested folders are inside the Maildir of their parent.
+			return fmt.Errorf("label %q cannot be used as a folder, %s is a Maildir directory", label, part)
+		}
+	}
+	return nil
+}
+
+// printDelivery prints what the filters would do to a message.
+func printDelivery(w io.Writer, name string, result simulation, d localDelivery) {
+	fmt.Fprintf(w, "%s:\n", name)
+	if len(result.matches) == 0 {
+		fmt.Fprintln(w, "  no filters match")
+	}
+	for _, pos := range result.matches {
+		fmt.Fprintf(w, "  matches %s\n", pos)
+	}
+
+	fmt.Fprintf(w, "  %-9s %s\n", "folders:", strings.Join(d.folders, ", "))
+	if len(d.flags) > 0 {
+		fmt.Fprintf(w, "  %-9s %s\n", "flags:", d.flags)
+	}
+	if len(d.skipped) > 0 {
+		fmt.Fprintf(w, "  %-9s %s\n", "skipped:", strings.Join(d.skipped, ", "))
+	}
+	fmt.Fprintln(w)
+}
+
+// readMailbox reads the messages of a Maildir, or of an mbox file, calling fn
+// with each of them in turn.
+func readMailbox(path string, fn func(localMessage) error) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return readMaildir(path, fn)
+	}
+	return readMbox(path, fn)
+}
+
+// readMaildir reads the messages in the new and cur directories of a Maildir,
+// one file at a time.
+func readMaildir(dir string, fn func(localMessage) error) error {
+	if fi, err := os.Stat(filepath.Join(dir, "cur")); err != nil || !fi.IsDir() {
+		return fmt.Errorf("%s is not a Maildir, it has no cur directory", dir)
+	}
+
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("reading directory %s failed: %v", filepath.Join(dir, sub), err)
+		}
+
+		for _, e := range entries {
+			if !e.Mode().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+
+			name := filepath.Join(dir, sub, e.Name())
+			raw, err := ioutil.ReadFile(name)
+			if err != nil {
+				return err
+			}
+
+			// The flags are at the end of the name, like :2,RS.
+			flags := ""
+			if i := strings.LastIndex(e.Name(), ":2,"); i >= 0 {
+				flags = e.Name()[i+3:]
+			}
+			if err := fn(localMessage{name: name, raw: raw, flags: flags}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readMbox reads the messages in an mbox file a line at a time, calling fn
+// with each message as soon as it ends. Lines in the body like >From are
+// unescaped, and the Status header of mail clients sets the seen flag.
+func readMbox(file string, fn func(localMessage) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		n       int
+		current *bytes.Buffer
+	)
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		// The blank line before the next From line is not part of the
+		// message.
+		raw := current.Bytes()
+		if bytes.HasSuffix(raw, []byte("\r\n\r\n")) {
+			raw = raw[:len(raw)-2]
+		} else if bytes.HasSuffix(raw, []byte("\n\n")) {
+			raw = raw[:len(raw)-1]
+		}
+		n++
+		return fn(localMessage{
+			name:  fmt.Sprintf("%s#%d", file, n),
+			raw:   raw,
+			flags: mboxFlags(raw),
+		})
+	}
+
+	r := bufio.NewReader(f)
+	blank := true
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("reading %s failed: %v", file, err)
+		}
+		if len(line) < 1 {
+			break
+		}
+
+		switch {
+		case blank && bytes.HasPrefix(line, []byte("From ")):
+			if err := finish(); err != nil {
+				return err
+			}
+			current = &bytes.Buffer{}
+		case current == nil:
+			return fmt.Errorf("%s is not an mbox file, it does not start with a From line", file)
+		default:
+			// Lines like >From are escaped From lines in the body.
+			if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+				line = line[1:]
+			}
+			current.Write(line)
+		}
+		blank = len(bytes.TrimRight(line, "\r\n")) == 0
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return finish()
+}
+
+// mboxFlags returns the Maildir flags for the Status and X-Status headers mail
+// clients add to messages in mbox files.
+func mboxFlags(raw []byte) string {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+
+	flags := ""
+	if strings.Contains(m.Header.Get("Status"), "R") {
+		flags += "S"
+	}
+	if strings.Contains(m.Header.Get("X-Status"), "F") {
+		flags += "F"
+	}
+	return flags
+}
+
+// maildirWriter writes messages into Maildir folders under a directory.
+type maildirWriter struct {
+	dir  string
+	host string
+	n    int
+	made map[string]bool
+}
+
+func newMaildirWriter(dir string) *maildirWriter {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	// Slashes and colons are not allowed in the names of messages.
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	return &maildirWriter{dir: dir, host: host, made: map[string]bool{}}
+}
+
+// write delivers a message into a folder. It is written to tmp first and then
+// moved into place, so a reader never sees half a message.
+func (mw *maildirWriter) write(folder string, m localMessage, flags string) error {
+	dir := filepath.Join(mw.dir, filepath.FromSlash(folder))
+	if !mw.made[dir] {
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+				return fmt.Errorf("creating Maildir %s failed: %v", dir, err)
+			}
+		}
+		mw.made[dir] = true
+	}
+
+	mw.n++
+	name := fmt.Sprintf("%d.M%dP%d.%s", time.Now().Unix(), mw.n, os.Getpid(), mw.host)
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, m.raw, 0600); err != nil {
+		return fmt.Errorf("writing message %s failed: %v", m.name, err)
+	}
+
+	// Messages without flags are new to mail clients.
+	dest := filepath.Join(dir, "new", name)
+	if len(flags) > 0 {
+		dest = filepath.Join(dir, "cur", name+":2,"+flags)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return fmt.Errorf("writing message %s failed: %v", m.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testMbox = `From notifications@github.com Mon Apr  1 12:00:00 2020
+From: GitHub <notifications@github.com>
+To: jess@example.com
+Subject: LGTM
+Status: RO
+
+LGTM, thanks!
+>From the review.
+
+From coreos-dev@googlegroups.com Mon Apr  1 12:00:00 2020
+From: Alex <alex@example.com>
+To: coreos-dev@googlegroups.com
+List-Id: <coreos-dev.googlegroups.com>
+Subject: Release
+
+A new release is out.
+
+From spam@example.com Mon Apr  1 12:00:00 2020
+From: spam@example.com
+To: jess@example.com
+Subject: Buy now
+
+>From our store to you.
+`
+
+func TestReadMbox(t *testing.T) {
+	file := writeTestFile(t, "mail.mbox", testMbox)
+	messages := readMessages(t, file)
+
+	expected := []localMessage{
+		{name: file + "#1", raw: []byte("From: GitHub <notifications@github.com>\nTo: jess@example.com\nSubject: LGTM\nStatus: RO\n\nLGTM, thanks!\nFrom the review.\n"), flags: "S"},
+		{name: file + "#2", raw: []byte("From: Alex <alex@example.com>\nTo: coreos-dev@googlegroups.com\nList-Id: <coreos-dev.googlegroups.com>\nSubject: Release\n\nA new release is out.\n")},
+		{name: file + "#3", raw: []byte("From: spam@example.com\nTo: jess@example.com\nSubject: Buy now\n\nFrom our store to you.\n")},
+	}
+	if diff := cmp.Diff(expected, messages, cmp.AllowUnexported(localMessage{})); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	err := readMailbox(writeTestFile(t, "notes.txt", "Not mail\n"), func(localMessage) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "is not an mbox file") {
+		t.Fatalf("expected an error for a file that is not an mbox, got %v", err)
+	}
+}
+
+func TestApplyLocal(t *testing.T) {
+	defer func(d bool) { dryRun = d }(dryRun)
+
+	filters, err := decodeFile(writeTestFile(t, "filters.toml", `[[filter]]
+from = "notifications@github.com"
+labels = ["github", "github/reviews"]
+archive = true
+
+[[filter]]
+query = "list:coreos-dev@googlegroups.com"
+label = "Mailing Lists/coreos-dev"
+archiveUnlessToMe = true
+read = true
+
+[[filter]]
+from = "spam@example.com"
+delete = true
+
+[[filter]]
+subject = "invoice"
+star = true
+forwardTo = "accounting@example.com"
+important = true
+
+[[filter]]
+subject = "lunch"
+archive = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mbox := writeTestFile(t, "mail.mbox", testMbox)
+	maildir := writeTestDir(t, map[string]string{
+		"cur/1.M1P1.host:2,S": "From: billing@example.com\nTo: jess@example.com\nSubject: Your invoice\n\nPay up.\n",
+		"new/2.M2P1.host":     "From: alex@example.com\nTo: jess@example.com\nSubject: Lunch?\n\nNoon?\n",
+		"tmp/3.M3P1.host":     "half written",
+	})
+
+	out := filepath.Join(writeTestDir(t, nil), "sorted")
+	var buf bytes.Buffer
+	if err := applyLocal(&buf, filters, []string{mbox, maildir}, []string{"jess@example.com"}, out); err != nil {
+		t.Fatal(err)
+	}
+
+	// The folders hold the subject of each message and where it is.
+	expected := map[string][]string{
+		"Archive":                  {"new: Lunch?"},
+		"INBOX":                    {"cur:FS Your invoice"},
+		"Mailing Lists/coreos-dev": {"cur:S Release"},
+		"Trash":                    {"new: Buy now"},
+		"github":                   {"cur:S LGTM"},
+		"github/reviews":           {"cur:S LGTM"},
+	}
+	if diff := cmp.Diff(expected, readMaildirs(t, out)); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	summary := `Sorted 5 messages into 6 folders
+  Archive                        1
+  INBOX                          1
+  Mailing Lists/coreos-dev       1
+  Trash                          1
+  github                         1
+  github/reviews                 1
+Actions that cannot be applied to local mail were skipped:
+  forward to accounting@example.com 1
+  mark as important              1
+`
+	if diff := cmp.Diff(summary, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// A dry run reports what would happen without writing anything.
+	dryRun = true
+	buf.Reset()
+	out = filepath.Join(filepath.Dir(out), "dry-run")
+	if err := applyLocal(&buf, filters, []string{maildir}, []string{"jess@example.com"}, out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be written in dry run mode, got %v", err)
+	}
+
+	report := filepath.Join(maildir, "new", "2.M2P1.host") + `:
+  matches ` + filters[4].pos.String() + `
+  folders:  Archive
+
+` + filepath.Join(maildir, "cur", "1.M1P1.host:2,S") + `:
+  matches ` + filters[3].pos.String() + `
+  folders:  INBOX
+  flags:    FS
+  skipped:  mark as important, forward to accounting@example.com
+
+Would sort 2 messages into 2 folders
+  Archive                        1
+  INBOX                          1
+Actions that cannot be applied to local mail were skipped:
+  forward to accounting@example.com 1
+  mark as important              1
+`
+	if diff := cmp.Diff(report, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestCheckFolderName(t *testing.T) {
+	testCases := map[string]string{
+		"github":         "",
+		"github/reviews": "",
+		"../outside":     `label "../outside" cannot be used as a folder`,
+		"github//x":      `label "github//x" cannot be used as a folder`,
+		"github/cur":     `label "github/cur" cannot be used as a folder, cur is a Maildir directory`,
+	}
+
+	for label, expected := range testCases {
+		err := checkFolderName(label)
+		if (err == nil && len(expected) > 0) || (err != nil && err.Error() != expected) {
+			t.Errorf("%s: expected error %q, got %v", label, expected, err)
+		}
+	}
+}
+
+// readMaildirs returns the messages in the Maildir folders under dir, as
+// their directory and flags and their subject.
+func readMaildirs(t *testing.T, dir string) map[string][]string {
+	folders := map[string][]string{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+
+		sub := filepath.Dir(path)
+		folder, err := filepath.Rel(dir, filepath.Dir(sub))
+		if err != nil {
+			return err
+		}
+
+		flags := ""
+		if i := strings.LastIndex(fi.Name(), ":2,"); i >= 0 {
+			flags = fi.Name()[i+3:]
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		parsed, err := parseMessage(raw)
+		if err != nil {
+			return err
+		}
+		folders[filepath.ToSlash(folder)] = append(folders[filepath.ToSlash(folder)], filepath.Base(sub)+":"+flags+" "+parsed.Header.Get("Subject"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, messages := range folders {
+		sort.Strings(messages)
+	}
+	return folders
+}
+
+// readMessages reads all the messages of a mailbox.
+func readMessages(t *testing.T, path string) []localMessage {
+	var messages []localMessage
+	err := readMailbox(path, func(m localMessage) error {
+		messages = append(messages, m)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// These are the namespaces of the mailFilters.xml feed the Gmail settings
+// export and import.
+const (
+	atomNamespace = "http://www.w3.org/2005/Atom"
+	appsNamespace = "http://schemas.google.com/apps/2006"
+)
+
+// smartLabels maps the category label IDs to the smart labels used for them
+// in mailFilters.xml.
+var smartLabels = map[string]string{
+	"CATEGORY_PERSONAL":   "^smartlabel_personal",
+	"CATEGORY_SOCIAL":     "^smartlabel_social",
+	"CATEGORY_PROMOTIONS": "^smartlabel_promo",
+	"CATEGORY_UPDATES":    "^smartlabel_notification",
+	"CATEGORY_FORUMS":     "^smartlabel_group",
+}
+
+// mailFiltersSizeUnits maps the size units of mailFilters.xml to bytes.
+var mailFiltersSizeUnits = map[string]int64{
+	"s_sb":  1,
+	"s_skb": 1 << 10,
+	"s_smb": 1 << 20,
+}
+
+// mailFiltersProperty is a property of a filter in mailFilters.xml.
+type mailFiltersProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// mailFiltersEntry is a filter in mailFilters.xml as it is read.
+type mailFiltersEntry struct {
+	Properties []mailFiltersProperty `xml:"http://schemas.google.com/apps/2006 property"`
+}
+
+// mailFiltersFeed is a mailFilters.xml feed as it is written. The encoder
+// cannot write namespace prefixes, so they are part of the names.
+type mailFiltersFeed struct {
+	XMLName   xml.Name               `xml:"feed"`
+	Namespace string                 `xml:"xmlns,attr"`
+	Apps      string                 `xml:"xmlns:apps,attr"`
+	Title     string                 `xml:"title"`
+	ID        string                 `xml:"id"`
+	Updated   string                 `xml:"updated"`
+	Entries   []mailFiltersFeedEntry `xml:"entry"`
+}
+
+type mailFiltersFeedEntry struct {
+	Category struct {
+		Term string `xml:"term,attr"`
+	} `xml:"category"`
+	Title      string                `xml:"title"`
+	ID         string                `xml:"id"`
+	Updated    string                `xml:"updated"`
+	Content    string                `xml:"content"`
+	Properties []mailFiltersProperty `xml:"apps:property"`
+}
+
+// decodeMailFilters decodes a mailFilters.xml feed. The pairs of filters the
+// Gmail settings make for archiveUnlessToMe filters are merged back together.
+func decodeMailFilters(file string, data []byte) (filterfile, configLayout, error) {
+	var (
+		gmailFilters []*gmail.Filter
+		positions    []position
+	)
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		// The offset before the token is where the element starts.
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return filterfile{}, configLayout{}, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "entry" {
+			continue
+		}
+
+		var entry mailFiltersEntry
+		if err := dec.DecodeElement(&entry, &start); err != nil {
+			return filterfile{}, configLayout{}, err
+		}
+
+		pos := position{file: file, line: bytes.Count(data[:offset], []byte("\n")) + 1}
+		gmailFilter, err := entry.gmailFilter(pos)
+		if err != nil {
+			return filterfile{}, configLayout{}, fmt.Errorf("line %d: %v", pos.line, err)
+		}
+
+		// An entry can only have one label, so merge the entries that only
+		// add another label to the filter before them.
+		if n := len(gmailFilters); n > 0 && isExtraLabelEntry(gmailFilters[n-1], gmailFilter) {
+			gmailFilters[n-1].Action.AddLabelIds = append(gmailFilters[n-1].Action.AddLabelIds, gmailFilter.Action.AddLabelIds...)
+			continue
+		}
+		gmailFilters = append(gmailFilters, gmailFilter)
+		positions = append(positions, pos)
+	}
+
+	var filters []filter
+	for i, gmailFilter := range gmailFilters {
+		// The labels are named rather than referenced by ID.
+		names := map[string]string{}
+		for _, label := range append(gmailFilter.Action.AddLabelIds, gmailFilter.Action.RemoveLabelIds...) {
+			names[label] = label
+		}
+
+		f := fromGmailFilter(gmailFilter, names)
+		f.pos = positions[i]
+		filters = append(filters, f)
+	}
+
+	ff := filterfile{Filter: mergeExportedFilters(filters)}
+	layout := newConfigLayout()
+	for _, f := range ff.Filter {
+		layout.addBlock("filter", f.pos.line)
+	}
+	return ff, layout, nil
+}
+
+// isExtraLabelEntry reports whether the entry only adds a label to the filter
+// before it.
+func isExtraLabelEntry(prev, entry *gmail.Filter) bool {
+	a := entry.Action
+	if len(a.AddLabelIds) != 1 || len(a.RemoveLabelIds) > 0 || len(a.Forward) > 0 {
+		return false
+	}
+	if _, ok := smartLabels[a.AddLabelIds[0]]; ok || isSystemLabel(a.AddLabelIds[0]) {
+		return false
+	}
+	return reflect.DeepEqual(prev.Criteria, entry.Criteria)
+}
+
+// isSystemLabel reports whether the label ID is one the filter actions use.
+func isSystemLabel(id string) bool {
+	switch id {
+	case "STARRED", "TRASH", "IMPORTANT":
+		return true
+	}
+	return false
+}
+
+// gmailFilter converts an entry into a Gmail filter. Properties we do not know
+// are skipped with a warning.
+func (e mailFiltersEntry) gmailFilter(pos position) (*gmail.Filter, error) {
+	c := &gmail.FilterCriteria{}
+	a := &gmail.FilterAction{}
+
+	var (
+		size int64
+		unit int64 = 1
+	)
+	for _, p := range e.Properties {
+		set := p.Value == "true"
+		switch p.Name {
+		case "from":
+			c.From = p.Value
+		case "to":
+			c.To = p.Value
+		case "subject":
+			c.Subject = p.Value
+		case "hasTheWord":
+			c.Query = p.Value
+		case "doesNotHaveTheWord":
+			c.NegatedQuery = p.Value
+		case "hasAttachment":
+			c.HasAttachment = set
+		case "excludeChats":
+			c.ExcludeChats = set
+		case "size":
+			n, err := strconv.ParseInt(p.Value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size %q", p.Value)
+			}
+			size = n
+		case "sizeOperator":
+			switch p.Value {
+			case "s_sl":
+				c.SizeComparison = "larger"
+			case "s_ss":
+				c.SizeComparison = "smaller"
+			default:
+				return nil, fmt.Errorf("invalid size operator %q", p.Value)
+			}
+		case "sizeUnit":
+			u, ok := mailFiltersSizeUnits[p.Value]
+			if !ok {
+				return nil, fmt.Errorf("invalid size unit %q", p.Value)
+			}
+			unit = u
+		case "label":
+			a.AddLabelIds = append(a.AddLabelIds, p.Value)
+		case "smartLabelToApply":
+			category := ""
+			for id, smartLabel := range smartLabels {
+				if smartLabel == p.Value {
+					category = id
+				}
+			}
+			if len(category) < 1 {
+				return nil, fmt.Errorf("invalid smart label %q", p.Value)
+			}
+			a.AddLabelIds = append(a.AddLabelIds, category)
+		case "shouldStar":
+			if set {
+				a.AddLabelIds = append(a.AddLabelIds, "STARRED")
+			}
+		case "shouldTrash":
+			if set {
+				a.AddLabelIds = append(a.AddLabelIds, "TRASH")
+			}
+		case "shouldAlwaysMarkAsImportant":
+			if set {
+				a.AddLabelIds = append(a.AddLabelIds, "IMPORTANT")
+			}
+		case "shouldArchive":
+			if set {
+				a.RemoveLabelIds = append(a.RemoveLabelIds, "INBOX")
+			}
+		case "shouldMarkAsRead":
+			if set {
+				a.RemoveLabelIds = append(a.RemoveLabelIds, "UNREAD")
+			}
+		case "shouldNeverSpam":
+			if set {
+				a.RemoveLabelIds = append(a.RemoveLabelIds, "SPAM")
+			}
+		case "shouldNeverMarkAsImportant":
+			if set {
+				a.RemoveLabelIds = append(a.RemoveLabelIds, "IMPORTANT")
+			}
+		case "forwardTo":
+			a.Forward = p.Value
+		default:
+			logrus.Warnf("%s: skipping unknown property %q", pos, p.Name)
+		}
+	}
+	if size > 0 {
+		c.Size = size * unit
+	}
+
+	return &gmail.Filter{Criteria: c, Action: a}, nil
+}
+
+// encodeMailFilters writes the filters as a mailFilters.xml feed that can be
+// imported in the Gmail settings.
+func encodeMailFilters(w io.Writer, ff filterfile) error {
+	// Make the Gmail filters against an empty account that only plans the
+	// labels, so we have IDs for them.
+	b := dryRunBackend{newMemoryBackend()}
+	labels, err := getLabelMap(b)
+	if err != nil {
+		return err
+	}
+
+	var gmailFilters []gmail.Filter
+	for _, f := range ff.Filter {
+		filters, err := f.toGmailFilters(&labels)
+		if err != nil {
+			return err
+		}
+		gmailFilters = append(gmailFilters, filters...)
+	}
+
+	names, err := getLabelMapOnID(b)
+	if err != nil {
+		return err
+	}
+	for _, id := range labels.ids {
+		if name, ok := plannedLabelName(id); ok {
+			names[id] = name
+		}
+	}
+
+	now := time.Now().UTC()
+	updated := now.Format(time.RFC3339)
+	feed := mailFiltersFeed{
+		Namespace: atomNamespace,
+		Apps:      appsNamespace,
+		Title:     "Mail Filters",
+		Updated:   updated,
+	}
+
+	var ids []string
+	for _, gmailFilter := range gmailFilters {
+		entries, err := mailFiltersProperties(gmailFilter, names)
+		if err != nil {
+			return err
+		}
+
+		for _, properties := range entries {
+			id := strconv.FormatInt(now.UnixNano()/int64(time.Millisecond)+int64(len(ids)), 10)
+			ids = append(ids, id)
+
+			entry := mailFiltersFeedEntry{
+				Title:      "Mail Filter",
+				ID:         "tag:mail.google.com,2008:filter:" + id,
+				Updated:    updated,
+				Properties: properties,
+			}
+			entry.Category.Term = "filter"
+			feed.Entries = append(feed.Entries, entry)
+		}
+	}
+	feed.ID = "tag:mail.google.com,2008:filters:" + strings.Join(ids, ",")
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// mailFiltersProperties returns the properties of the entries for a Gmail
+// filter. An entry can only have one label, so the other labels get entries
+// of their own with the same criteria.
+func mailFiltersProperties(gmailFilter gmail.Filter, labels map[string]string) ([][]mailFiltersProperty, error) {
+	var criteria []mailFiltersProperty
+	add := func(name, value string) {
+		if len(value) > 0 {
+			criteria = append(criteria, mailFiltersProperty{Name: name, Value: value})
+		}
+	}
+
+	c := gmailFilter.Criteria
+	add("from", c.From)
+	add("to", c.To)
+	add("subject", c.Subject)
+	add("hasTheWord", c.Query)
+	add("doesNotHaveTheWord", c.NegatedQuery)
+	if c.HasAttachment {
+		add("hasAttachment", "true")
+	}
+	if c.ExcludeChats {
+		add("excludeChats", "true")
+	}
+	if c.Size > 0 {
+		operator := "s_sl"
+		if c.SizeComparison == "smaller" {
+			operator = "s_ss"
+		}
+		size, unit := c.Size, "s_sb"
+		for _, u := range []string{"s_smb", "s_skb"} {
+			if c.Size%mailFiltersSizeUnits[u] == 0 {
+				size, unit = c.Size/mailFiltersSizeUnits[u], u
+				break
+			}
+		}
+		add("size", strconv.FormatInt(size, 10))
+		add("sizeOperator", operator)
+		add("sizeUnit", unit)
+	}
+
+	actions := append([]mailFiltersProperty{}, criteria...)
+	flag := func(name string) {
+		actions = append(actions, mailFiltersProperty{Name: name, Value: "true"})
+	}
+
+	var userLabels []string
+	for _, id := range gmailFilter.Action.AddLabelIds {
+		switch id {
+		case "STARRED":
+			flag("shouldStar")
+		case "TRASH":
+			flag("shouldTrash")
+		case "IMPORTANT":
+			flag("shouldAlwaysMarkAsImportant")
+		default:
+			if smartLabel, ok := smartLabels[id]; ok {
+				actions = append(actions, mailFiltersProperty{Name: "smartLabelToApply", Value: smartLabel})
+				continue
+			}
+			userLabels = append(userLabels, labelName(labels, id))
+		}
+	}
+	for _, id := range gmailFilter.Action.RemoveLabelIds {
+		switch id {
+		case "INBOX":
+			flag("shouldArchive")
+		case "UNREAD":
+			flag("shouldMarkAsRead")
+		case "SPAM":
+			flag("shouldNeverSpam")
+		case "IMPORTANT":
+			flag("shouldNeverMarkAsImportant")
+		default:
+			return nil, fmt.Errorf("cannot remove label %q, mailFilters.xml only supports adding labels", labelName(labels, id))
+		}
+	}
+	if len(gmailFilter.Action.Forward) > 0 {
+		actions = append(actions, mailFiltersProperty{Name: "forwardTo", Value: gmailFilter.Action.Forward})
+	}
+
+	if len(userLabels) == 0 {
+		return [][]mailFiltersProperty{actions}, nil
+	}
+
+	entries := [][]mailFiltersProperty{
+		append(actions, mailFiltersProperty{Name: "label", Value: userLabels[0]}),
+	}
+	for _, label := range userLabels[1:] {
+		entries = append(entries, append(append([]mailFiltersProperty{}, criteria...), mailFiltersProperty{Name: "label", Value: label}))
+	}
+	return entries, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testMailFilters is a mailFilters.xml like the Gmail settings export.
+const testMailFilters = `<?xml version='1.0' encoding='UTF-8'?><feed xmlns='http://www.w3.org/2005/Atom' xmlns:apps='http://schemas.google.com/apps/2006'>
+	<title>Mail Filters</title>
+	<id>tag:mail.google.com,2008:filters:z0000001,z0000002,z0000003,z0000004,z0000005,z0000006</id>
+	<updated>2020-04-01T12:00:00Z</updated>
+	<author>
+		<name>Jess Frazelle</name>
+		<email>jess@example.com</email>
+	</author>
+	<entry>
+		<category term='filter'></category>
+		<title>Mail Filter</title>
+		<id>tag:mail.google.com,2008:filter:z0000001</id>
+		<updated>2020-04-01T12:00:00Z</updated>
+		<content></content>
+		<apps:property name='from' value='notifications@github.com'/>
+		<apps:property name='label' value='github'/>
+		<apps:property name='shouldAlwaysMarkAsImportant' value='true'/>
+		<apps:property name='sizeOperator' value='s_sl'/>
+		<apps:property name='sizeUnit' value='s_smb'/>
+	</entry>
+	<entry>
+		<category term='filter'></category>
+		<title>Mail Filter</title>
+		<id>tag:mail.google.com,2008:filter:z0000002</id>
+		<updated>2020-04-01T12:00:00Z</updated>
+		<content></content>
+		<apps:property name='from' value='notifications@github.com'/>
+		<apps:property name='label' value='github/mentions'/>
+		<apps:property name='sizeOperator' value='s_sl'/>
+		<apps:property name='sizeUnit' value='s_smb'/>
+	</entry>
+	<entry>
+		<category term='filter'></category>
+		<title>Mail Filter</title>
+		<id>tag:mail.google.com,2008:filter:z0000003</id>
+		<updated>2020-04-01T12:00:00Z</updated>
+		<content></content>
+		<apps:property name='hasTheWord' value='list:coreos-dev@googlegroups.com'/>
+		<apps:property name='to' value='me'/>
+		<apps:property name='label' value='Mailing Lists/coreos-dev'/>
+	</entry>
+	<entry>
+		<category term='filter'></category>
+		<title>Mail Filter</title>
+		<id>tag:mail.google.com,2008:filter:z0000004</id>
+		<updated>2020-04-01T12:00:00Z</updated>
+		<content></content>
+		<apps:property name='hasTheWord' value='list:coreos-dev@googlegroups.com'/>
+		<apps:property name='doesNotHaveTheWord' value='to:me'/>
+		<apps:property name='label' value='Mailing Lists/coreos-dev'/>
+		<apps:property name='shouldArchive' value='true'/>
+	</entry>
+	<entry>
+		<category term='filter'></category>
+		<title>Mail Filter</title>
+		<id>tag:mail.google.com,2008:filter:z0000005</id>
+		<updated>2020-04-01T12:00:00Z</updated>
+		<content></content>
+		<apps:property name='from' value='newsletter@example.com'/>
+		<apps:property name='hasAttachment' value='true'/>
+		<apps:property name='size' value='5'/>
+		<apps:property name='sizeOperator' value='s_ss'/>
+		<apps:property name='sizeUnit' value='s_smb'/>
+		<apps:property name='smartLabelToApply' value='^smartlabel_promo'/>
+		<apps:property name='shouldNeverMarkAsImportant' value='true'/>
+		<apps:property name='shouldMarkAsRead' value='true'/>
+	</entry>
+	<entry>
+		<category term='filter'></category>
+		<title>Mail Filter</title>
+		<id>tag:mail.google.com,2008:filter:z0000006</id>
+		<updated>2020-04-01T12:00:00Z</updated>
+		<content></content>
+		<apps:property name='hasTheWord' value='to:plans@tripit.com OR to:receipts@expensify.com'/>
+		<apps:property name='shouldTrash' value='true'/>
+		<apps:property name='forwardTo' value='accounting@example.com'/>
+	</entry>
+</feed>`
+
+func TestDecodeMailFilters(t *testing.T) {
+	file := writeTestFile(t, "mailFilters.xml", testMailFilters)
+	filters, err := decodeFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []filter{
+		{From: "notifications@github.com", Labels: []string{"github", "github/mentions"}, Important: true, pos: position{file: file, line: 9}},
+		{Query: "list:coreos-dev@googlegroups.com", Label: "Mailing Lists/coreos-dev", ArchiveUnlessToMe: true, pos: position{file: file, line: 32}},
+		{From: "newsletter@example.com", HasAttachment: true, SizeLessThan: "5MB", Category: "promotions", NeverImportant: true, Read: true, pos: position{file: file, line: 53}},
+		{Query: "to:plans@tripit.com OR to:receipts@expensify.com", Delete: true, ForwardTo: "accounting@example.com", pos: position{file: file, line: 68}},
+	}
+	if diff := cmp.Diff(expected, filters, cmp.AllowUnexported(filter{}, position{})); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestEncodeMailFilters(t *testing.T) {
+	filters, err := decodeFile(writeTestFile(t, "mailFilters.xml", testMailFilters))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := encodeMailFilters(&buf, filterfile{Filter: filters}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`<feed xmlns="http://www.w3.org/2005/Atom" xmlns:apps="http://schemas.google.com/apps/2006">`,
+		`<apps:property name="label" value="github/mentions"></apps:property>`,
+		`<apps:property name="smartLabelToApply" value="^smartlabel_promo"></apps:property>`,
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("expected the feed to contain %s, got:\n%s", s, buf.String())
+		}
+	}
+
+	// Decoding the feed again should give the same filters.
+	reimported, err := decodeFile(writeTestFile(t, "mailFilters.xml", buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range filters {
+		filters[i].pos = position{}
+	}
+	for i := range reimported {
+		reimported[i].pos = position{}
+	}
+	if diff := cmp.Diff(filters, reimported, cmp.AllowUnexported(filter{}, position{})); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// Removing labels cannot be written.
+	err = encodeMailFilters(&buf, filterfile{Filter: []filter{{From: "builds@travis-ci.org", RemoveLabels: []string{"github"}}}})
+	if err == nil || !strings.Contains(err.Error(), `cannot remove label "github"`) {
+		t.Fatalf("expected an error for removeLabels, got %v", err)
+	}
+}
@@ -2,18 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/genuinetools/pkg/cli"
 	"github.com/jessfraz/gmailfilters/version"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
 )
@@ -22,16 +24,42 @@ const (
 	gmailUser = "me"
 )
 
+// scopes are the OAuth scopes we need. If modifying these scopes, delete your
+// previously saved token.
+var scopes = []string{
+	// Manage labels.
+	gmail.GmailLabelsScope,
+	// Read, modify, and manage your settings.
+	gmail.GmailSettingsBasicScope,
+}
+
+// requestModifyScope adds the scope to change messages, which is only needed
+// when filters are applied to existing messages.
+func requestModifyScope() {
+	scopes = appendUnique(scopes, gmail.GmailModifyScope)
+}
+
 var (
 	credsFile string
 
-	tokenFile string
+	tokenFile      string
+	tokenStoreKind string
+	account        string
 
-	api *gmail.Service
+	usersFlag   string
+	backendFlag string
+
+	profileName string
+	filterFile  string
+	format      string
 
 	debug bool
 
 	export bool
+
+	dryRun bool
+
+	applyExisting bool
 )
 
 func main() {
@@ -51,11 +79,43 @@ func main() {
 	p.FlagSet.BoolVar(&export, "e", false, "export existing filters")
 	p.FlagSet.BoolVar(&export, "export", false, "export existing filters")
 
+	p.FlagSet.BoolVar(&dryRun, "n", false, "print the changes that would be made without making them")
+	p.FlagSet.BoolVar(&dryRun, "dry-run", false, "print the changes that would be made without making them")
+
+	p.FlagSet.BoolVar(&applyExisting, "apply-existing", false, "apply all the filters to existing messages after syncing, not just the ones with applyToExisting")
+
 	p.FlagSet.StringVar(&credsFile, "creds-file", os.Getenv("GMAIL_CREDENTIAL_FILE"), "Gmail credential file (or env var GMAIL_CREDENTIAL_FILE)")
 	p.FlagSet.StringVar(&credsFile, "f", os.Getenv("GMAIL_CREDENTIAL_FILE"), "Gmail credential file (or env var GMAIL_CREDENTIAL_FILE)")
 
-	p.FlagSet.StringVar(&tokenFile, "token-file", filepath.Join(os.TempDir(), "token.json"), "Gmail oauth token file")
-	p.FlagSet.StringVar(&tokenFile, "t", filepath.Join(os.TempDir(), "token.json"), "Gmail oauth token file")
+	p.FlagSet.StringVar(&usersFlag, "user", gmailUser, "comma separated users to sync the filters of, other users need a service account key as the credential file")
+	p.FlagSet.StringVar(&usersFlag, "u", gmailUser, "comma separated users to sync the filters of, other users need a service account key as the credential file")
+
+	p.FlagSet.StringVar(&tokenFile, "token-file", "", "Gmail oauth token file, instead of a file per account in the config directory")
+	p.FlagSet.StringVar(&tokenFile, "t", "", "Gmail oauth token file, instead of a file per account in the config directory")
+
+	p.FlagSet.StringVar(&tokenStoreKind, "token-store", "file", "where to store oauth tokens: file, encrypted or exec:COMMAND")
+
+	p.FlagSet.StringVar(&account, "account", "default", "name of the account to use the token of, like your email address")
+	p.FlagSet.StringVar(&account, "a", "default", "name of the account to use the token of, like your email address")
+
+	p.FlagSet.StringVar(&backendFlag, "backend", "gmail", "where to sync the filters to: gmail, or sieve://user@host[:port][/script] for a ManageSieve server with the password in "+sievePasswordEnv)
+
+	p.FlagSet.StringVar(&format, "format", "", "format of the filter config file: toml, yaml, json, jsonnet, xml or sieve (default from the file extension)")
+
+	p.FlagSet.StringVar(&profileName, "profile", os.Getenv("GMAILFILTERS_PROFILE"), "profile from the config file to use (or env var GMAILFILTERS_PROFILE)")
+
+	// Build the list of available commands.
+	p.Commands = []cli.Command{
+		&applyLocalCommand{},
+		&convertCommand{},
+		&expandCommand{},
+		&fleetCommand{},
+		&loginCommand{},
+		&logoutCommand{},
+		&testCommand{},
+		&validateCommand{},
+		&whoamiCommand{},
+	}
 
 	// Set the before function.
 	p.Before = func(ctx context.Context) error {
@@ -64,47 +124,35 @@ func main() {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
 
-		if len(credsFile) < 1 {
-			return errors.New("the Gmail credential file cannot be empty")
-		}
-
-		// Make sure the file exists.
-		if _, err := os.Stat(credsFile); os.IsNotExist(err) {
-			return fmt.Errorf("credential file %s does not exist", credsFile)
-		}
-
-		// Read the credentials file.
-		b, err := ioutil.ReadFile(credsFile)
+		// Use the settings of the profile for the flags that were not
+		// passed.
+		file, err := defaultToolConfigFile()
 		if err != nil {
-			return fmt.Errorf("reading client secret file %s failed: %v", credsFile, err)
+			if len(profileName) > 0 {
+				return err
+			}
+			return nil
 		}
-
-		// If modifying these scopes, delete your previously saved token.json.
-		config, err := google.ConfigFromJSON(b,
-			// Manage labels.
-			gmail.GmailLabelsScope,
-			// Read, modify, and manage your settings.
-			gmail.GmailSettingsBasicScope)
+		config, err := loadToolConfig(file)
 		if err != nil {
-			return fmt.Errorf("parsing client secret file to config failed: %v", err)
+			return err
 		}
-
-		// Get the client from the config.
-		client, err := getClient(ctx, tokenFile, config)
+		prof, ok, err := config.profile(profileName)
 		if err != nil {
-			return fmt.Errorf("creating client failed: %v", err)
+			return err
 		}
-
-		// Create the service for the Gmail client.
-		api, err = gmail.New(client)
-		if err != nil {
-			return fmt.Errorf("creating Gmail client failed: %v", err)
+		if ok {
+			logrus.Debugf("Using profile for account %s", prof.Account)
+			applyProfile(p.FlagSet, prof)
 		}
 
 		return nil
 	}
 
 	p.Action = func(ctx context.Context, args []string) error {
+		if len(args) < 1 && len(filterFile) > 0 {
+			args = []string{filterFile}
+		}
 		if len(args) < 1 {
 			return errors.New("must pass a path to a gmail filter configuration file")
 		}
@@ -120,35 +168,63 @@ func main() {
 			}
 		}()
 
-		if export {
-			return exportExistingFilters(args[0])
-		}
-
-		labels, err := getLabelMap()
+		sieve, err := parseBackend(backendFlag)
 		if err != nil {
 			return err
 		}
 
+		users := getUsers()
+
+		if export {
+			if sieve != nil {
+				return exportSieveFilters(sieve, args[0])
+			}
+
+			if len(users) > 1 {
+				return errors.New("can only export the filters of one user at a time")
+			}
+
+			api, err := newAPIBackend(ctx, users[0])
+			if err != nil {
+				return err
+			}
+			return exportExistingFilters(api, args[0])
+		}
+
 		fmt.Printf("Decoding filters from file %s\n", args[0])
 		filters, err := decodeFile(args[0])
 		if err != nil {
 			return err
 		}
 
-		// Delete our existing filters.
-		if err := deleteExistingFilters(); err != nil {
-			return err
+		if sieve != nil {
+			if applyExisting {
+				return errors.New("--apply-existing only works with the gmail backend")
+			}
+			return applySieveFilters(sieve, filters)
 		}
 
-		// Convert our filters into gmail filters and add them.
-		fmt.Printf("Updating %d filters, this might take a bit...\n", len(filters))
-		for _, f := range filters {
-			if err := f.addFilter(&labels); err != nil {
-				return err
-			}
+		if wantsApplyToExisting(filters) {
+			requestModifyScope()
+		}
+
+		if len(users) == 1 {
+			return applyFilters(ctx, users[0], filters)
 		}
 
-		fmt.Printf("Successfully updated %d filters\n", len(filters))
+		// Keep going if a user fails so one bad mailbox does not stop the
+		// rest from being synced.
+		failed := 0
+		for _, user := range users {
+			fmt.Printf("\nUser %s:\n", user)
+			if err := applyFilters(ctx, user, filters); err != nil {
+				logrus.Errorf("Syncing filters for %s failed: %v", user, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("syncing filters failed for %d of %d users", failed, len(users))
+		}
 
 		return nil
 	}
@@ -156,3 +232,173 @@ func main() {
 	// Run our program.
 	p.Run()
 }
+
+// applyFilters syncs the filters to the user's account, or prints the plan in
+// dry run mode.
+func applyFilters(ctx context.Context, user string, filters []filter) error {
+	api, err := newAPIBackend(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		// Plan against a backend that cannot change the account.
+		diff, err := planSync(dryRunBackend{api}, filters)
+		if err != nil {
+			return err
+		}
+
+		names, err := getLabelMapOnID(api)
+		if err != nil {
+			return err
+		}
+
+		printPlan(os.Stdout, diff, names)
+
+		if wantsApplyToExisting(filters) {
+			return applyToExisting(os.Stdout, dryRunBackend{api}, filters, applyExisting)
+		}
+		return nil
+	}
+
+	// Sync our filters with the ones on the account.
+	fmt.Printf("Syncing %d filters, this might take a bit...\n", len(filters))
+	diff, err := syncFilters(api, filters)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully synced filters: %d created, %d deleted, %d unchanged\n", len(diff.create), len(diff.delete), diff.unchanged)
+
+	if wantsApplyToExisting(filters) {
+		return applyToExisting(os.Stdout, api, filters, applyExisting)
+	}
+
+	return nil
+}
+
+// getUsers returns the users from the flags.
+func getUsers() []string {
+	var users []string
+	for _, user := range strings.Split(usersFlag, ",") {
+		if user = strings.TrimSpace(user); len(user) > 0 {
+			users = append(users, user)
+		}
+	}
+	if len(users) == 0 {
+		return []string{gmailUser}
+	}
+	return users
+}
+
+// newAPIBackend creates a backend for the Gmail API. The user's mailbox is
+// managed by impersonating them if the credential file is a service account
+// key, otherwise the user must be me and the token from the flags is used.
+func newAPIBackend(ctx context.Context, user string) (*gmailBackend, error) {
+	b, err := readCredsFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if isServiceAccountKey(b) {
+		return newServiceAccountBackend(ctx, b, user)
+	}
+	if user != gmailUser {
+		return nil, fmt.Errorf("cannot manage the filters of %s with an OAuth client, the credential file must be a service account key with domain-wide delegation", user)
+	}
+
+	config, err := getOAuthConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := getTokenStore()
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the client from the config.
+	client, err := getClient(ctx, store, account, config)
+	if err != nil {
+		return nil, fmt.Errorf("creating client failed: %v", err)
+	}
+
+	// Create the service for the Gmail client.
+	svc, err := gmail.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("creating Gmail client failed: %v", err)
+	}
+
+	return newGmailBackend(svc, gmailUser), nil
+}
+
+// getTokenStore returns the token store from the flags.
+func getTokenStore() (tokenStore, error) {
+	return newTokenStore(tokenStoreKind, "", tokenFile)
+}
+
+// newServiceAccountBackend creates a backend for the Gmail API that manages
+// the user's mailbox by impersonating them with a service account key that has
+// domain-wide delegation.
+func newServiceAccountBackend(ctx context.Context, key []byte, user string) (*gmailBackend, error) {
+	if user == gmailUser {
+		return nil, errors.New("must pass the users to impersonate with --user when the credential file is a service account key")
+	}
+
+	config, err := google.JWTConfigFromJSON(key, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing service account key failed: %v", err)
+	}
+	config.Subject = user
+
+	svc, err := gmail.New(config.Client(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("creating Gmail client failed: %v", err)
+	}
+
+	return newGmailBackend(svc, user), nil
+}
+
+// isServiceAccountKey reports whether the credential file is a service
+// account key rather than an OAuth client.
+func isServiceAccountKey(b []byte) bool {
+	var key struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(b, &key) == nil && key.Type == "service_account"
+}
+
+// getOAuthConfig reads the OAuth client config from the credential file.
+func getOAuthConfig() (*oauth2.Config, error) {
+	b, err := readCredsFile()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := google.ConfigFromJSON(b, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing client secret file to config failed: %v", err)
+	}
+
+	return config, nil
+}
+
+// readCredsFile reads the credential file from the flags.
+func readCredsFile() ([]byte, error) {
+	if len(credsFile) < 1 {
+		return nil, errors.New("the Gmail credential file cannot be empty")
+	}
+
+	// Make sure the file exists.
+	if _, err := os.Stat(credsFile); os.IsNotExist(err) {
+		return nil, fmt.Errorf("credential file %s does not exist", credsFile)
+	}
+
+	// Read the credentials file.
+	b, err := ioutil.ReadFile(credsFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client secret file %s failed: %v", credsFile, err)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// testDir holds the files written by the tests. It is removed once all the
+// tests have run.
+var testDir string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "gmailfilters")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	testDir = dir
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestServiceAccountBackend(t *testing.T) {
+	const user = "alice@corp.com"
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			// Check the assertion impersonates the user.
+			r.ParseForm()
+			parts := strings.Split(r.Form.Get("assertion"), ".")
+			if len(parts) != 3 {
+				http.Error(w, "bad assertion", http.StatusBadRequest)
+				return
+			}
+			payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var claims struct {
+				Sub   string `json:"sub"`
+				Scope string `json:"scope"`
+			}
+			if err := json.Unmarshal(payload, &claims); err != nil || claims.Sub != user || !strings.Contains(claims.Scope, gmail.GmailSettingsBasicScope) {
+				http.Error(w, "bad claims", http.StatusUnauthorized)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"impersonated","token_type":"Bearer","expires_in":3600}`))
+		case "/gmail/v1/users/" + user + "/settings/filters":
+			if r.Header.Get("Authorization") != "Bearer impersonated" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"filter":[{"id":"1","criteria":{"from":"boss@corp.com"}}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "gmailfilters@corp.iam.gserviceaccount.com",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pk)})),
+		"token_uri":      s.URL + "/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isServiceAccountKey(key) {
+		t.Fatal("expected the key to be a service account key")
+	}
+
+	if _, err := newServiceAccountBackend(context.Background(), key, gmailUser); err == nil {
+		t.Fatal("expected an error without a user to impersonate")
+	}
+
+	b, err := newServiceAccountBackend(context.Background(), key, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.svc.BasePath = s.URL + "/gmail/v1/users/"
+
+	filters, err := b.ListFilters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 1 || filters[0].Criteria.From != "boss@corp.com" {
+		t.Fatalf("unexpected filters: %#v", filters)
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// sievePort is the port ManageSieve servers listen on.
+	sievePort = "4190"
+	// sieveScriptName is the name of the script we upload, unless the
+	// backend URL has one.
+	sieveScriptName = "gmailfilters"
+	// sievePasswordEnv is the environment variable the password for the
+	// ManageSieve server is read from, unless the backend URL has one.
+	sievePasswordEnv = "GMAILFILTERS_SIEVE_PASSWORD"
+)
+
+// sieveBackend is a ManageSieve server (RFC 5804) to upload the filters to
+// as a Sieve script, from a backend URL like sieve://user@host:4190/script.
+type sieveBackend struct {
+	addr     string
+	host     string
+	user     string
+	password string
+	script   string
+}
+
+// parseBackend parses the --backend flag. It returns nil for the Gmail API.
+func parseBackend(s string) (*sieveBackend, error) {
+	if len(s) < 1 || s == "gmail" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "sieve" || len(u.Hostname()) < 1 {
+		return nil, fmt.Errorf("unknown backend %q, must be gmail or sieve://user@host", s)
+	}
+
+	b := &sieveBackend{
+		host:   u.Hostname(),
+		script: strings.Trim(u.Path, "/"),
+	}
+	port := u.Port()
+	if len(port) < 1 {
+		port = sievePort
+	}
+	b.addr = net.JoinHostPort(b.host, port)
+	if len(b.script) < 1 {
+		b.script = sieveScriptName
+	}
+
+	if u.User == nil || len(u.User.Username()) < 1 {
+		return nil, fmt.Errorf("backend %q must have a user, like sieve://user@%s", s, b.host)
+	}
+	b.user = u.User.Username()
+	if password, ok := u.User.Password(); ok {
+		b.password = password
+	} else {
+		b.password = os.Getenv(sievePasswordEnv)
+	}
+	if len(b.password) < 1 {
+		return nil, fmt.Errorf("the password for %s cannot be empty, set it in %s", b.addr, sievePasswordEnv)
+	}
+
+	return b, nil
+}
+
+// me returns our addresses for to:me in the script, the user if it is an
+// email address.
+func (b *sieveBackend) me() []string {
+	if strings.Contains(b.user, "@") {
+		return []string{b.user}
+	}
+	return nil
+}
+
+// applySieveFilters uploads the filters to the ManageSieve server as a script,
+// checks it and activates it, or only checks it in dry run mode.
+func applySieveFilters(b *sieveBackend, filters []filter) error {
+	var buf bytes.Buffer
+	if _, err := encodeSieve(&buf, filterfile{Filter: filters}, b.me()); err != nil {
+		return err
+	}
+	script := buf.String()
+
+	c, err := dialSieve(b)
+	if err != nil {
+		return err
+	}
+	defer c.logout()
+
+	// Scripts with errors would be rejected when they are uploaded anyway,
+	// but CHECKSCRIPT tells us why without changing anything.
+	if err := c.checkScript(script); err != nil {
+		return fmt.Errorf("checking sieve script failed: %v", err)
+	}
+
+	current, active, err := c.getScript(b.script)
+	if err != nil {
+		return err
+	}
+	if current == script && active {
+		fmt.Printf("Sieve script %s on %s is already up to date\n", b.script, b.addr)
+		return nil
+	}
+
+	if dryRun {
+		fmt.Printf("Would upload and activate sieve script %s on %s:\n\n%s", b.script, b.addr, script)
+		return nil
+	}
+
+	fmt.Printf("Uploading %d filters as sieve script %s to %s\n", len(filters), b.script, b.addr)
+	if err := c.putScript(b.script, script); err != nil {
+		return fmt.Errorf("uploading sieve script failed: %v", err)
+	}
+	if err := c.setActive(b.script); err != nil {
+		return fmt.Errorf("activating sieve script failed: %v", err)
+	}
+
+	fmt.Printf("Successfully uploaded and activated sieve script %s\n", b.script)
+	return nil
+}
+
+// exportSieveFilters writes the filters of the active script on the
+// ManageSieve server to a file.
+func exportSieveFilters(b *sieveBackend, file string) error {
+	fmt.Print("exporting existing filters...\n")
+
+	c, err := dialSieve(b)
+	if err != nil {
+		return err
+	}
+	defer c.logout()
+
+	scripts, err := c.listScripts()
+	if err != nil {
+		return err
+	}
+	name := ""
+	for _, s := range scripts {
+		if s.active {
+			name = s.name
+		}
+	}
+	if len(name) < 1 {
+		return fmt.Errorf("there is no active sieve script on %s", b.addr)
+	}
+
+	script, _, err := c.getScript(name)
+	if err != nil {
+		return err
+	}
+	ff, _, err := decodeSieve(name, []byte(script))
+	if err != nil {
+		return fmt.Errorf("decoding sieve script %s failed: %v", name, err)
+	}
+
+	return writeFiltersToFile(ff, file)
+}
+
+// sieveClient is a connection to a ManageSieve server.
+type sieveClient struct {
+	conn         net.Conn
+	r            *bufio.Reader
+	capabilities map[string]string
+}
+
+// sieveScript is a script on a ManageSieve server.
+type sieveScript struct {
+	name   string
+	active bool
+}
+
+// sieveTimeout is how long we wait for the ManageSieve server.
+const sieveTimeout = 30 * time.Second
+
+// dialSieve connects and authenticates to the ManageSieve server. The
+// connection is upgraded with STARTTLS when the server offers it, and the
+// password is only sent in the clear to the local machine.
+func dialSieve(b *sieveBackend) (*sieveClient, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, sieveTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s failed: %v", b.addr, err)
+	}
+	c := &sieveClient{conn: conn, r: bufio.NewReader(conn)}
+
+	// The server greets us with its capabilities.
+	if err := c.readCapabilities(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, ok := c.capabilities["STARTTLS"]; ok {
+		if _, err := c.command("STARTTLS"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: b.host})
+		c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+		if err := c.readCapabilities(); err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+	} else if ip := net.ParseIP(b.host); b.host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		conn.Close()
+		return nil, fmt.Errorf("%s does not offer STARTTLS, refusing to send the password in the clear", b.addr)
+	}
+
+	if !strings.Contains(" "+strings.ToUpper(c.capabilities["SASL"])+" ", " PLAIN ") {
+		c.conn.Close()
+		return nil, fmt.Errorf("%s does not support PLAIN authentication", b.addr)
+	}
+	response := base64.StdEncoding.EncodeToString([]byte("\x00" + b.user + "\x00" + b.password))
+	if _, err := c.command("AUTHENTICATE", "PLAIN", response); err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("authenticating to %s as %s failed: %v", b.addr, b.user, err)
+	}
+
+	return c, nil
+}
+
+// readCapabilities reads the capabilities the server sends when we connect
+// and after STARTTLS.
+func (c *sieveClient) readCapabilities() error {
+	lines, err := c.response()
+	if err != nil {
+		return err
+	}
+
+	c.capabilities = map[string]string{}
+	for _, line := range lines {
+		if len(line) < 1 {
+			continue
+		}
+		value := ""
+		if len(line) > 1 {
+			value = line[1]
+		}
+		c.capabilities[strings.ToUpper(line[0])] = value
+	}
+	return nil
+}
+
+// listScripts lists the scripts on the server.
+func (c *sieveClient) listScripts() ([]sieveScript, error) {
+	lines, err := c.command("LISTSCRIPTS")
+	if err != nil {
+		return nil, fmt.Errorf("listing sieve scripts failed: %v", err)
+	}
+
+	var scripts []sieveScript
+	for _, line := range lines {
+		if len(line) < 1 {
+			continue
+		}
+		scripts = append(scripts, sieveScript{
+			name:   line[0],
+			active: len(line) > 1 && strings.EqualFold(line[1], "ACTIVE"),
+		})
+	}
+	return scripts, nil
+}
+
+// getScript returns the script with the name passed and whether it is active.
+// A script that does not exist is empty.
+func (c *sieveClient) getScript(name string) (string, bool, error) {
+	scripts, err := c.listScripts()
+	if err != nil {
+		return "", false, err
+	}
+	for _, s := range scripts {
+		if s.name != name {
+			continue
+		}
+
+		lines, err := c.command("GETSCRIPT", name)
+		if err != nil {
+			return "", false, fmt.Errorf("getting sieve script %s failed: %v", name, err)
+		}
+		if len(lines) < 1 || len(lines[0]) < 1 {
+			return "", false, fmt.Errorf("getting sieve script %s failed: empty response", name)
+		}
+		return lines[0][0], s.active, nil
+	}
+	return "", false, nil
+}
+
+// checkScript checks the script is valid without uploading it.
+func (c *sieveClient) checkScript(script string) error {
+	_, err := c.command("CHECKSCRIPT", script)
+	return err
+}
+
+// putScript uploads the script with the name passed.
+func (c *sieveClient) putScript(name, script string) error {
+	_, err := c.command("PUTSCRIPT", name, script)
+	return err
+}
+
+// setActive makes the script with the name passed the active one.
+func (c *sieveClient) setActive(name string) error {
+	_, err := c.command("SETACTIVE", name)
+	return err
+}
+
+// logout ends the session and closes the connection.
+func (c *sieveClient) logout() {
+	if _, err := c.command("LOGOUT"); err != nil {
+		logrus.Debugf("Logging out of the sieve server failed: %v", err)
+	}
+	c.conn.Close()
+}
+
+// command sends a command and returns the lines of the response before the
+// OK. A NO or BYE response is an error with the message of the server.
+func (c *sieveClient) command(name string, args ...string) ([][]string, error) {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, arg := range args {
+		b.WriteString(" ")
+		// Quoted strings cannot have line breaks and must be short, so
+		// scripts are sent as literals.
+		if strings.ContainsAny(arg, "\r\n\"\\") || len(arg) > 1024 {
+			fmt.Fprintf(&b, "{%d+}\r\n%s", len(arg), arg)
+			continue
+		}
+		b.WriteString(`"` + arg + `"`)
+	}
+	b.WriteString("\r\n")
+
+	c.conn.SetDeadline(time.Now().Add(sieveTimeout))
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.response()
+}
+
+// response reads the lines of a response up to the OK, NO or BYE that ends it.
+func (c *sieveClient) response() ([][]string, error) {
+	var lines [][]string
+	for {
+		line, err := readSieveLine(c.r)
+		if err != nil {
+			return nil, fmt.Errorf("reading response failed: %v", err)
+		}
+		if len(line) < 1 {
+			continue
+		}
+
+		switch status := strings.ToUpper(line[0]); status {
+		case "OK":
+			return lines, nil
+		case "NO", "BYE":
+			msg := status
+			if n := len(line); n > 1 {
+				msg = line[n-1]
+			}
+			return lines, errors.New(msg)
+		}
+		lines = append(lines, line)
+	}
+}
+
+// readSieveLine reads a line of a ManageSieve response and returns its words:
+// atoms, quoted strings, literals and response codes in parentheses.
+func readSieveLine(r *bufio.Reader) ([]string, error) {
+	var words []string
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch c {
+		case ' ', '\r':
+		case '\n':
+			return words, nil
+		case '"':
+			var b strings.Builder
+			for {
+				c, err := r.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				if c == '\\' {
+					if c, err = r.ReadByte(); err != nil {
+						return nil, err
+					}
+				} else if c == '"' {
+					break
+				}
+				b.WriteByte(c)
+			}
+			words = append(words, b.String())
+		case '{':
+			size, err := r.ReadString('}')
+			if err != nil {
+				return nil, err
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(size, "}"), "+"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid literal {%s", size)
+			}
+			if rest, err := r.ReadString('\n'); err != nil || strings.TrimSpace(rest) != "" {
+				return nil, fmt.Errorf("invalid literal {%s", size)
+			}
+			literal := make([]byte, n)
+			if _, err := io.ReadFull(r, literal); err != nil {
+				return nil, err
+			}
+			words = append(words, string(literal))
+		case '(':
+			code, err := r.ReadString(')')
+			if err != nil {
+				return nil, err
+			}
+			words = append(words, "("+code)
+		default:
+			var b strings.Builder
+			b.WriteByte(c)
+			for {
+				next, err := r.Peek(1)
+				if err != nil || strings.ContainsRune(" \r\n", rune(next[0])) {
+					break
+				}
+				r.ReadByte()
+				b.WriteByte(next[0])
+			}
+			words = append(words, b.String())
+		}
+	}
+}
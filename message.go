@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jessfraz/gmailfilters/query"
+)
+
+// messageFile is a message loaded from a file.
+type messageFile struct {
+	name string
+	msg  *query.Message
+}
+
+// loadMessageFiles loads the RFC 822 messages in the files passed. The files
+// in a directory are all loaded, skipping hidden files.
+func loadMessageFiles(paths []string) ([]messageFile, error) {
+	var files []messageFile
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		names := []string{path}
+		if fi.IsDir() {
+			entries, err := ioutil.ReadDir(path)
+			if err != nil {
+				return nil, fmt.Errorf("reading directory %s failed: %v", path, err)
+			}
+
+			names = nil
+			for _, e := range entries {
+				if e.Mode().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+					names = append(names, filepath.Join(path, e.Name()))
+				}
+			}
+		}
+
+		for _, name := range names {
+			b, err := ioutil.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+
+			msg, err := parseMessage(b)
+			if err != nil {
+				return nil, fmt.Errorf("parsing message %s failed: %v", name, err)
+			}
+
+			files = append(files, messageFile{name: name, msg: msg})
+		}
+	}
+
+	return files, nil
+}
+
+// parseMessage parses an RFC 822 message into something queries can be
+// matched against.
+func parseMessage(b []byte) (*query.Message, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &query.Message{
+		Header: mail.Header{},
+		Size:   int64(len(b)),
+	}
+
+	// Decode any RFC 2047 encoded words in the headers.
+	dec := &mime.WordDecoder{}
+	for key, values := range m.Header {
+		for _, v := range values {
+			if decoded, err := dec.DecodeHeader(v); err == nil {
+				v = decoded
+			}
+			msg.Header[key] = append(msg.Header[key], v)
+		}
+	}
+
+	if date, err := m.Header.Date(); err == nil {
+		msg.Date = date
+	}
+
+	var body []string
+	if err := walkMessagePart(m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Header.Get("Content-Disposition"), m.Body, msg, &body); err != nil {
+		return nil, err
+	}
+	msg.Body = strings.Join(body, "\n")
+
+	return msg, nil
+}
+
+// walkMessagePart adds the text and attachment names of a part of a message,
+// and of any parts nested in it, to the message.
+func walkMessagePart(contentType, encoding, disposition string, r io.Reader, msg *query.Message, body *[]string) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Messages without a valid content type are plain text.
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			// The multipart reader already decodes quoted-printable parts.
+			if err := walkMessagePart(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p.Header.Get("Content-Disposition"), p, msg, body); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, dparams, _ := mime.ParseMediaType(disposition)
+	filename := dparams["filename"]
+	if len(filename) < 1 {
+		filename = params["name"]
+	}
+	if len(filename) > 0 || strings.HasPrefix(disposition, "attachment") {
+		msg.Filenames = append(msg.Filenames, filename)
+		return nil
+	}
+
+	if !strings.HasPrefix(mediaType, "text/") {
+		return nil
+	}
+
+	switch strings.ToLower(encoding) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	*body = append(*body, string(b))
+
+	return nil
+}
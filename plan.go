@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// printPlan prints the changes in a diff as a terraform style plan. The names
+// map label IDs to their names so the actions can be printed readably.
+func printPlan(w io.Writer, diff filterDiff, names map[string]string) {
+	if len(diff.labels) == 0 && len(diff.create) == 0 && len(diff.delete) == 0 {
+		fmt.Fprintf(w, "No changes. The %d filters on the account match the configuration.\n", diff.unchanged)
+		return
+	}
+
+	fmt.Fprint(w, "The following changes would be made:\n\n")
+
+	for _, name := range diff.labels {
+		fmt.Fprintf(w, "  + label %q\n\n", name)
+	}
+
+	for _, f := range diff.create {
+		fmt.Fprint(w, "  + filter\n")
+		printFilter(w, &f, names)
+		fmt.Fprintln(w)
+	}
+
+	for _, f := range diff.delete {
+		fmt.Fprintf(w, "  - filter %s\n", f.Id)
+		printFilter(w, f, names)
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Plan: %d labels to create, %d filters to create, %d filters to delete, %d unchanged.\n",
+		len(diff.labels), len(diff.create), len(diff.delete), diff.unchanged)
+}
+
+// printFilter prints the set criteria and action fields of a Gmail filter.
+func printFilter(w io.Writer, f *gmail.Filter, names map[string]string) {
+	field := func(name, value string) {
+		if len(value) > 0 {
+			fmt.Fprintf(w, "      %-15s %s\n", name+":", value)
+		}
+	}
+
+	if c := f.Criteria; c != nil {
+		field("from", quote(c.From))
+		field("to", quote(c.To))
+		field("subject", quote(c.Subject))
+		field("query", quote(normalizeQuery(c.Query)))
+		field("negatedQuery", quote(normalizeQuery(c.NegatedQuery)))
+		if c.HasAttachment {
+			field("hasAttachment", "true")
+		}
+		if c.ExcludeChats {
+			field("excludeChats", "true")
+		}
+		if c.Size > 0 {
+			field("size", fmt.Sprintf("%s %d bytes", c.SizeComparison, c.Size))
+		}
+	}
+
+	if a := f.Action; a != nil {
+		field("addLabels", labelNames(a.AddLabelIds, names))
+		field("removeLabels", labelNames(a.RemoveLabelIds, names))
+		field("forward", quote(a.Forward))
+	}
+}
+
+// labelNames returns a readable list of the labels for the IDs passed.
+func labelNames(ids []string, names map[string]string) string {
+	if len(ids) == 0 {
+		return ""
+	}
+
+	s := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if name, ok := plannedLabelName(id); ok {
+			s = append(s, fmt.Sprintf("%q", name))
+			continue
+		}
+		if name, ok := names[id]; ok {
+			s = append(s, fmt.Sprintf("%q", name))
+			continue
+		}
+		s = append(s, id)
+	}
+
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+func quote(s string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%q", s)
+}
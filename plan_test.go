@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestPrintPlan(t *testing.T) {
+	diff := filterDiff{
+		labels: []string{"github/LGTM"},
+		create: []gmail.Filter{
+			{
+				Action: &gmail.FilterAction{
+					AddLabelIds: []string{plannedLabelPrefix + "github/LGTM"},
+				},
+				Criteria: &gmail.FilterCriteria{
+					Query: "from:notifications@github.com LGTM",
+				},
+			},
+		},
+		delete: []*gmail.Filter{
+			{
+				Id: "ANe1Bmj",
+				Action: &gmail.FilterAction{
+					AddLabelIds:    []string{"Label_1"},
+					RemoveLabelIds: []string{"INBOX"},
+				},
+				Criteria: &gmail.FilterCriteria{
+					Query:        "list:coreos-dev@googlegroups.com",
+					NegatedQuery: "to:me",
+				},
+			},
+		},
+		unchanged: 3,
+	}
+
+	names := map[string]string{
+		"INBOX":   "INBOX",
+		"Label_1": "Mailing Lists/coreos-dev",
+	}
+
+	expected := `The following changes would be made:
+
+  + label "github/LGTM"
+
+  + filter
+      query:          "from:notifications@github.com LGTM"
+      addLabels:      ["github/LGTM"]
+
+  - filter ANe1Bmj
+      query:          "list:coreos-dev@googlegroups.com"
+      negatedQuery:   "to:me"
+      addLabels:      ["Mailing Lists/coreos-dev"]
+      removeLabels:   ["INBOX"]
+
+Plan: 1 labels to create, 1 filters to create, 1 filters to delete, 3 unchanged.
+`
+
+	var b bytes.Buffer
+	printPlan(&b, diff, names)
+
+	if diff := cmp.Diff(expected, b.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// toolConfig is the config file of gmailfilters itself, as opposed to the
+// filter config files.
+type toolConfig struct {
+	// DefaultProfile is the profile used when --profile is not passed.
+	DefaultProfile string             `toml:"defaultProfile"`
+	Profiles       map[string]profile `toml:"profiles"`
+}
+
+// profile holds the settings for an account. Flags passed on the command line
+// override them.
+type profile struct {
+	CredsFile  string `toml:"credsFile"`
+	TokenStore string `toml:"tokenStore"`
+	TokenFile  string `toml:"tokenFile"`
+	// Account is the name the token is stored under. It defaults to the
+	// name of the profile.
+	Account string `toml:"account"`
+	// User is a comma separated list of users, like --user.
+	User string `toml:"user"`
+	// FilterFile is the filter config file used when none is passed.
+	FilterFile string `toml:"filterFile"`
+	// Backend is where the filters are synced to, like --backend.
+	Backend string `toml:"backend"`
+}
+
+// defaultToolConfigFile returns the path of the tool config file, like
+// $XDG_CONFIG_HOME/gmailfilters/config.toml.
+func defaultToolConfigFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("finding config directory failed: %v", err)
+	}
+	return filepath.Join(dir, "gmailfilters", "config.toml"), nil
+}
+
+// loadToolConfig decodes the tool config file. A missing file is an empty
+// config. Paths in profiles are expanded and made relative to the directory
+// of the config file.
+func loadToolConfig(file string) (toolConfig, error) {
+	var c toolConfig
+	md, err := toml.DecodeFile(file, &c)
+	if os.IsNotExist(err) {
+		return toolConfig{}, nil
+	}
+	if err != nil {
+		return c, fmt.Errorf("decoding config file %s failed: %v", file, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return c, fmt.Errorf("%s: unknown key %q", file, undecoded[0].String())
+	}
+
+	dir := filepath.Dir(file)
+	for name, p := range c.Profiles {
+		p.CredsFile = expandPath(dir, p.CredsFile)
+		p.TokenFile = expandPath(dir, p.TokenFile)
+		p.FilterFile = expandPath(dir, p.FilterFile)
+		c.Profiles[name] = p
+	}
+
+	return c, nil
+}
+
+// profile returns the profile with the name passed, or the default profile if
+// the name is empty. It returns false if no profile was asked for.
+func (c toolConfig) profile(name string) (profile, bool, error) {
+	if len(name) < 1 {
+		name = c.DefaultProfile
+	}
+	if len(name) < 1 {
+		return profile{}, false, nil
+	}
+
+	p, ok := c.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(c.Profiles))
+		for n := range c.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return profile{}, false, fmt.Errorf("unknown profile %q, no profiles are defined", name)
+		}
+		return profile{}, false, fmt.Errorf("unknown profile %q, must be one of %s", name, strings.Join(names, ", "))
+	}
+
+	if len(p.Account) < 1 {
+		p.Account = name
+	}
+	return p, true, nil
+}
+
+// applyProfile sets the flag variables from the profile, except for the flags
+// passed on the command line.
+func applyProfile(fs *flag.FlagSet, p profile) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	apply := func(v *string, value string, names ...string) {
+		for _, name := range names {
+			if set[name] {
+				return
+			}
+		}
+		if len(value) > 0 {
+			*v = value
+		}
+	}
+	apply(&credsFile, p.CredsFile, "f", "creds-file")
+	apply(&tokenStoreKind, p.TokenStore, "token-store")
+	apply(&tokenFile, p.TokenFile, "t", "token-file")
+	apply(&account, p.Account, "a", "account")
+	apply(&usersFlag, p.User, "u", "user")
+	apply(&filterFile, p.FilterFile)
+	apply(&backendFlag, p.Backend, "backend")
+}
+
+// expandPath expands a leading ~ to the home directory and makes relative
+// paths relative to dir.
+func expandPath(dir, path string) string {
+	if len(path) < 1 {
+		return path
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[1:])
+		}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return path
+}
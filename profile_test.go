@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadToolConfig(t *testing.T) {
+	file := writeTestFile(t, "config.toml", `defaultProfile = "personal"
+
+[profiles.personal]
+credsFile = "personal.json"
+filterFile = "/home/me/filters.toml"
+
+[profiles.work]
+credsFile = "work.json"
+tokenStore = "encrypted"
+account = "me@corp.com"
+user = "me@corp.com"
+`)
+	dir := filepath.Dir(file)
+
+	c, err := loadToolConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		name        string
+		expected    profile
+		expectedErr string
+	}{
+		"default profile": {
+			expected: profile{
+				CredsFile:  filepath.Join(dir, "personal.json"),
+				Account:    "personal",
+				FilterFile: "/home/me/filters.toml",
+			},
+		},
+		"named profile": {
+			name: "work",
+			expected: profile{
+				CredsFile:  filepath.Join(dir, "work.json"),
+				TokenStore: "encrypted",
+				Account:    "me@corp.com",
+				User:       "me@corp.com",
+			},
+		},
+		"unknown profile": {
+			name:        "wrok",
+			expectedErr: `unknown profile "wrok", must be one of personal, work`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			p, ok, err := c.profile(tc.name)
+			if len(tc.expectedErr) > 0 {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Fatalf("expected error %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatal("expected a profile")
+			}
+			if diff := cmp.Diff(tc.expected, p); len(diff) > 1 {
+				t.Fatalf("profile differs: %s", diff)
+			}
+		})
+	}
+
+	// A missing config file has no profiles.
+	c, err = loadToolConfig(filepath.Join(dir, "missing.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := c.profile(""); ok || err != nil {
+		t.Fatalf("expected no profile, got %t, %v", ok, err)
+	}
+}
+
+func TestApplyProfileKeepsFlags(t *testing.T) {
+	defer func(c, a, u string) { credsFile, account, usersFlag = c, a, u }(credsFile, account, usersFlag)
+
+	fs := flag.NewFlagSet("gmailfilters", flag.ContinueOnError)
+	fs.StringVar(&credsFile, "f", "", "")
+	fs.StringVar(&account, "a", "default", "")
+	fs.StringVar(&usersFlag, "u", gmailUser, "")
+	if err := fs.Parse([]string{"-f", "flag.json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	applyProfile(fs, profile{CredsFile: "profile.json", Account: "work"})
+
+	if credsFile != "flag.json" {
+		t.Fatalf("expected the flag to win, got %q", credsFile)
+	}
+	if account != "work" {
+		t.Fatalf("expected the profile account, got %q", account)
+	}
+	if usersFlag != gmailUser {
+		t.Fatalf("expected the default user to be kept, got %q", usersFlag)
+	}
+}
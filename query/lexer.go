@@ -0,0 +1,110 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokWord
+	tokQuoted
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokMinus
+	tokPlus
+	tokOr
+	tokAnd
+)
+
+// token is a lexical token of a query.
+type token struct {
+	typ  tokenType
+	text string
+	// pos and end are the byte offsets of the start and end of the token in
+	// the query.
+	pos int
+	end int
+}
+
+// SyntaxError is returned when a query cannot be parsed.
+type SyntaxError struct {
+	// Pos is the byte offset in the query where the error is.
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at column %d", e.Msg, e.Pos+1)
+}
+
+// lex splits a query into tokens.
+func lex(q string) ([]token, error) {
+	var toks []token
+
+	i := 0
+	for i < len(q) {
+		c := q[i]
+
+		switch {
+		case isSpace(c):
+			i++
+		case c == '(':
+			toks = append(toks, token{typ: tokLParen, text: "(", pos: i, end: i + 1})
+			i++
+		case c == ')':
+			toks = append(toks, token{typ: tokRParen, text: ")", pos: i, end: i + 1})
+			i++
+		case c == '{':
+			toks = append(toks, token{typ: tokLBrace, text: "{", pos: i, end: i + 1})
+			i++
+		case c == '}':
+			toks = append(toks, token{typ: tokRBrace, text: "}", pos: i, end: i + 1})
+			i++
+		case (c == '-' || c == '+') && i+1 < len(q) && !isSpace(q[i+1]):
+			// A - or + is only an operator when it is stuck to what follows.
+			typ := tokMinus
+			if c == '+' {
+				typ = tokPlus
+			}
+			toks = append(toks, token{typ: typ, text: string(c), pos: i, end: i + 1})
+			i++
+		case c == '"':
+			end := strings.IndexByte(q[i+1:], '"')
+			if end < 0 {
+				return nil, &SyntaxError{Pos: i, Msg: "unterminated quoted phrase"}
+			}
+			end += i + 1
+			toks = append(toks, token{typ: tokQuoted, text: q[i+1 : end], pos: i, end: end + 1})
+			i = end + 1
+		default:
+			start := i
+			for i < len(q) && !isSpace(q[i]) && !strings.ContainsRune(`(){}"`, rune(q[i])) {
+				i++
+			}
+			word := q[start:i]
+
+			typ := tokWord
+			switch word {
+			case "OR", "|":
+				typ = tokOr
+			case "AND":
+				typ = tokAnd
+			}
+			toks = append(toks, token{typ: typ, text: word, pos: start, end: i})
+		}
+	}
+
+	return append(toks, token{typ: tokEOF, pos: len(q), end: len(q)}), nil
+}
+
+// isSpace reports whether a byte separates words. Only ASCII whitespace is
+// checked, since the bytes of multi-byte UTF-8 characters like à include 0x85
+// and 0xA0, which unicode.IsSpace would treat as spaces.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
@@ -0,0 +1,181 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Severity is how bad a problem with a query is.
+type Severity int
+
+const (
+	// Warning is for something that is probably a mistake, but that Gmail
+	// will still accept.
+	Warning Severity = iota
+	// Error is for something that is definitely a mistake.
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+// Problem is a problem found in a query.
+type Problem struct {
+	// Pos is the byte offset in the query where the problem is.
+	Pos      int
+	Severity Severity
+	Msg      string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s at column %d", p.Msg, p.Pos+1)
+}
+
+// Operators are the Gmail search operators and, for the ones that only take
+// a fixed set of values, the values they take.
+var Operators = map[string][]string{
+	"after":       nil,
+	"bcc":         nil,
+	"before":      nil,
+	"category":    {"primary", "social", "promotions", "updates", "forums", "reservations", "purchases"},
+	"cc":          nil,
+	"deliveredto": nil,
+	"filename":    nil,
+	"from":        nil,
+	"has":         {"attachment", "drive", "document", "spreadsheet", "presentation", "youtube", "userlabels", "nouserlabels", "yellow-star", "orange-star", "red-star", "purple-star", "blue-star", "green-star", "red-bang", "orange-guillemet", "yellow-bang", "green-check", "blue-info", "purple-question"},
+	"in":          {"anywhere", "inbox", "trash", "spam", "snoozed", "sent", "draft", "drafts", "chats", "important", "starred", "unread"},
+	"is":          {"important", "starred", "unread", "read", "snoozed", "muted", "chat"},
+	"label":       nil,
+	"larger":      nil,
+	"list":        nil,
+	"newer":       nil,
+	"newer_than":  nil,
+	"older":       nil,
+	"older_than":  nil,
+	"rfc822msgid": nil,
+	"size":        nil,
+	"smaller":     nil,
+	"subject":     nil,
+	"to":          nil,
+}
+
+// Lint parses a query and returns any problems found with it. A query that
+// cannot be parsed has a single Error problem.
+func Lint(q string) []Problem {
+	n, err := Parse(q)
+	if err != nil {
+		if serr, ok := err.(*SyntaxError); ok {
+			return []Problem{{Pos: serr.Pos, Severity: Error, Msg: serr.Msg}}
+		}
+		return []Problem{{Severity: Error, Msg: err.Error()}}
+	}
+
+	var problems []Problem
+	Walk(n, func(n Node) {
+		switch n := n.(type) {
+		case *Operator:
+			problems = append(problems, lintOperator(n)...)
+		case *Term:
+			if strings.HasSuffix(n.Text, `\`) {
+				problems = append(problems, Problem{
+					Pos:      n.Pos,
+					Severity: Error,
+					Msg:      `stray \, use a multi-line basic string (""") for line continuations`,
+				})
+			}
+		}
+	})
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Pos < problems[j].Pos
+	})
+
+	return problems
+}
+
+func lintOperator(o *Operator) []Problem {
+	name := strings.ToLower(o.Name)
+
+	values, ok := Operators[name]
+	if !ok {
+		// Gmail just searches for the text of an unknown operator, but one
+		// that is close to a known one is most likely a typo.
+		names := make([]string, 0, len(Operators))
+		for op := range Operators {
+			names = append(names, op)
+		}
+		msg := fmt.Sprintf("unknown operator %s:", o.Name)
+		if suggestion := Suggest(name, names); len(suggestion) > 0 && len(name) > 3 {
+			msg += fmt.Sprintf(", did you mean %s:?", suggestion)
+		}
+		return []Problem{{Pos: o.Pos, Severity: Warning, Msg: msg}}
+	}
+
+	// Check the value if the operator only takes a fixed set of values.
+	term, ok := o.Value.(*Term)
+	if len(values) == 0 || !ok {
+		return nil
+	}
+	value := strings.ToLower(term.Text)
+	for _, v := range values {
+		if v == value {
+			return nil
+		}
+	}
+
+	msg := fmt.Sprintf("unknown value %s for operator %s:", term.Text, o.Name)
+	if suggestion := Suggest(value, values); len(suggestion) > 0 {
+		msg += fmt.Sprintf(", did you mean %s:%s?", o.Name, suggestion)
+	}
+	return []Problem{{Pos: o.Pos, Severity: Warning, Msg: msg}}
+}
+
+// Suggest returns the candidate closest to s, ignoring case, if it is close
+// enough to be a typo. Otherwise it returns an empty string.
+func Suggest(s string, candidates []string) string {
+	// Sort the candidates so ties always give the same suggestion.
+	sorted := append([]string{}, candidates...)
+	sort.Strings(sorted)
+
+	best, bestDistance := "", 3
+	for _, c := range sorted {
+		if d := levenshtein(strings.ToLower(s), strings.ToLower(c)); d < bestDistance {
+			best, bestDistance = c, d
+		}
+	}
+	return best
+}
+
+// levenshtein returns the edit distance between two strings.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
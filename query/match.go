@@ -0,0 +1,341 @@
+package query
+
+import (
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Message is a message a query can be matched against.
+type Message struct {
+	// Header holds the headers of the message.
+	Header mail.Header
+	// Body is the text of the message.
+	Body string
+	// Filenames are the names of the attachments of the message.
+	Filenames []string
+	// Size is the size of the message in bytes.
+	Size int64
+	// Date is when the message was received.
+	Date time.Time
+	// Labels are the names of the labels the message has.
+	Labels []string
+	// Me holds the addresses that match "me" in operators like to:me.
+	Me []string
+	// Now is the time relative dates like older_than: are compared to.
+	// It defaults to the current time.
+	Now time.Time
+}
+
+// Match reports whether the message matches a query syntax tree. It is a
+// local approximation of Gmail's search: terms match whole words anywhere
+// in the headers or body and ignore case.
+func Match(n Node, m *Message) bool {
+	switch n := n.(type) {
+	case *And:
+		for _, c := range n.Nodes {
+			if !Match(c, m) {
+				return false
+			}
+		}
+		return true
+	case *Or:
+		for _, c := range n.Nodes {
+			if Match(c, m) {
+				return true
+			}
+		}
+		return false
+	case *Not:
+		return !Match(n.Node, m)
+	case *Group:
+		return Match(n.Node, m)
+	case *Term:
+		return containsWord(m.text(), n.Text)
+	case *Phrase:
+		return containsWord(m.text(), n.Text)
+	case *Operator:
+		return matchOperator(n, m)
+	}
+	return false
+}
+
+// text returns all the searchable text of the message.
+func (m *Message) text() string {
+	var s []string
+	for _, key := range []string{"From", "To", "Cc", "Subject"} {
+		s = append(s, m.Header.Get(key))
+	}
+	s = append(s, m.Filenames...)
+	s = append(s, m.Body)
+	return strings.Join(s, "\n")
+}
+
+func matchOperator(o *Operator, m *Message) bool {
+	switch name := strings.ToLower(o.Name); name {
+	case "from", "to", "cc", "bcc", "deliveredto":
+		header := map[string]string{
+			"from":        "From",
+			"to":          "To",
+			"cc":          "Cc",
+			"bcc":         "Bcc",
+			"deliveredto": "Delivered-To",
+		}[name]
+		return matchAddress(o.Value, m, m.Header.Get(header))
+	case "subject":
+		return matchValue(o.Value, m.Header.Get("Subject"))
+	case "list":
+		// List IDs look like <coreos-dev.googlegroups.com> but they are
+		// searched for like list:coreos-dev@googlegroups.com.
+		list := m.Header.Get("List-Id") + " " + m.Header.Get("List-Post")
+		return matchValueFunc(o.Value, func(v string) bool {
+			return strings.Contains(normalizeList(list), normalizeList(v))
+		})
+	case "filename":
+		return matchValueFunc(o.Value, func(v string) bool {
+			for _, f := range m.Filenames {
+				if strings.Contains(strings.ToLower(f), strings.ToLower(v)) {
+					return true
+				}
+			}
+			return false
+		})
+	case "has":
+		return matchValueFunc(o.Value, func(v string) bool {
+			switch strings.ToLower(v) {
+			case "attachment":
+				return len(m.Filenames) > 0
+			case "userlabels":
+				return len(m.Labels) > 0
+			case "nouserlabels":
+				return len(m.Labels) == 0
+			}
+			return false
+		})
+	case "label":
+		return matchValueFunc(o.Value, func(v string) bool {
+			for _, l := range m.Labels {
+				if normalizeLabel(l) == normalizeLabel(v) {
+					return true
+				}
+			}
+			return false
+		})
+	case "in", "is":
+		// New mail is unread and in the inbox.
+		return matchValueFunc(o.Value, func(v string) bool {
+			switch strings.ToLower(v) {
+			case "inbox", "unread", "anywhere":
+				return true
+			}
+			return false
+		})
+	case "category":
+		return matchValueFunc(o.Value, func(v string) bool {
+			return strings.ToLower(v) == "primary"
+		})
+	case "larger", "size":
+		return matchValueFunc(o.Value, func(v string) bool {
+			size, ok := parseSize(v)
+			return ok && m.Size >= size
+		})
+	case "smaller":
+		return matchValueFunc(o.Value, func(v string) bool {
+			size, ok := parseSize(v)
+			return ok && m.Size < size
+		})
+	case "after", "newer", "before", "older":
+		return matchValueFunc(o.Value, func(v string) bool {
+			t, err := time.Parse("2006/1/2", v)
+			if err != nil || m.Date.IsZero() {
+				return false
+			}
+			if name == "after" || name == "newer" {
+				return !m.Date.Before(t)
+			}
+			return m.Date.Before(t)
+		})
+	case "older_than", "newer_than":
+		return matchValueFunc(o.Value, func(v string) bool {
+			d, ok := parseRelativeDate(v, m.now())
+			if !ok || m.Date.IsZero() {
+				return false
+			}
+			if name == "older_than" {
+				return m.Date.Before(d)
+			}
+			return m.Date.After(d)
+		})
+	case "rfc822msgid":
+		return matchValueFunc(o.Value, func(v string) bool {
+			return strings.Trim(m.Header.Get("Message-Id"), "<>") == strings.Trim(v, "<>")
+		})
+	}
+
+	// Gmail searches for unknown operators as text.
+	return containsWord(m.text(), o.String())
+}
+
+// matchAddress matches the value of an address operator against a header.
+// The value me matches any of the addresses in Message.Me.
+func matchAddress(value Node, m *Message, header string) bool {
+	return matchValueFunc(value, func(v string) bool {
+		if strings.ToLower(v) != "me" {
+			return containsWord(header, v)
+		}
+
+		addrs, err := mail.ParseAddressList(header)
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			for _, me := range m.Me {
+				if strings.EqualFold(addr.Address, me) {
+					return true
+				}
+			}
+		}
+		return false
+	})
+}
+
+// matchValue matches the value of an operator against a field of text.
+func matchValue(value Node, text string) bool {
+	return matchValueFunc(value, func(v string) bool {
+		return containsWord(text, v)
+	})
+}
+
+// matchValueFunc evaluates the value of an operator, which could be a group
+// like from:(a OR b), calling fn for every term and phrase in it.
+func matchValueFunc(value Node, fn func(string) bool) bool {
+	switch v := value.(type) {
+	case *Term:
+		return fn(v.Text)
+	case *Phrase:
+		return fn(v.Text)
+	case *Not:
+		return !matchValueFunc(v.Node, fn)
+	case *Group:
+		return matchValueFunc(v.Node, fn)
+	case *And:
+		for _, c := range v.Nodes {
+			if !matchValueFunc(c, fn) {
+				return false
+			}
+		}
+		return true
+	case *Or:
+		for _, c := range v.Nodes {
+			if matchValueFunc(c, fn) {
+				return true
+			}
+		}
+		return false
+	case *Operator:
+		return fn(v.String())
+	}
+	return false
+}
+
+// wordRegex matches the words Gmail searches for, a * matches any characters
+// within a word.
+var wordRegex = regexp.MustCompile(`[\pL\pN_*]+`)
+
+// wordRegexps caches the compiled regexp for the words of a query, since the
+// same query is matched against many messages.
+var wordRegexps sync.Map
+
+// containsWord reports whether text contains the words, ignoring case and any
+// punctuation between them, at a word boundary.
+func containsWord(text, words string) bool {
+	v, ok := wordRegexps.Load(words)
+	if !ok {
+		v, _ = wordRegexps.LoadOrStore(words, compileWords(words))
+	}
+	re := v.(*regexp.Regexp)
+	return re != nil && re.MatchString(strings.ToLower(text))
+}
+
+// compileWords returns the regexp matching the words, or nil if there are no
+// words to match.
+func compileWords(words string) *regexp.Regexp {
+	tokens := wordRegex.FindAllString(strings.ToLower(words), -1)
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(regexp.QuoteMeta(token), `\*`, `[\pL\pN_]*`, -1)
+	}
+	pattern := strings.Join(tokens, `[^\pL\pN_]+`)
+
+	re, err := regexp.Compile(`(^|[^\pL\pN_])` + pattern + `($|[^\pL\pN_])`)
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+func normalizeList(s string) string {
+	return strings.Replace(strings.ToLower(s), "@", ".", -1)
+}
+
+func normalizeLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '-' || unicode.IsSpace(r) {
+			return '-'
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+func (m *Message) now() time.Time {
+	if m.Now.IsZero() {
+		return time.Now()
+	}
+	return m.Now
+}
+
+// parseSize parses the value of a size operator like 10M, 5k or 1024.
+func parseSize(s string) (int64, bool) {
+	s = strings.ToLower(s)
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "m"), strings.HasSuffix(s, "mb"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "kb"):
+		multiplier = 1 << 10
+	}
+	n, err := strconv.ParseInt(strings.TrimRight(s, "kmb"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n * multiplier, true
+}
+
+// parseRelativeDate parses the value of older_than: or newer_than: like 2d,
+// 3m or 1y into the date that far before now.
+func parseRelativeDate(s string, now time.Time) (time.Time, bool) {
+	if len(s) < 2 {
+		return time.Time{}, false
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "d":
+		return now.AddDate(0, 0, -n), true
+	case "m":
+		return now.AddDate(0, -n, 0), true
+	case "y":
+		return now.AddDate(-n, 0, 0), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,68 @@
+package query
+
+import (
+	"net/mail"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	msg := &Message{
+		Header: mail.Header{
+			"From":    {"GitHub <notifications@github.com>"},
+			"To":      {"jess@example.com, team_mention@noreply.github.com"},
+			"Subject": {"Re: [jessfraz/gmailfilters] Add a test command (#42) voilà"},
+			"List-Id": {"<coreos-dev.googlegroups.com>"},
+		},
+		Body:      "LGTM, thanks!\n\n@jessfraz\nÅsa",
+		Filenames: []string{"invite.ics"},
+		Size:      2048,
+		Date:      time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+		Now:       time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC),
+		Me:        []string{"jess@example.com"},
+	}
+
+	testCases := map[string]bool{
+		"lgtm":                                true,
+		"LGT":                                 false,
+		`"thanks @jessfraz"`:                  true,
+		"from:notifications@github.com":       true,
+		"from:github.com":                     true,
+		"from:(-notifications@github.com)":    false,
+		"to:me":                               true,
+		"from:me":                             false,
+		"to:(mention@noreply.github.com)":     false,
+		"subject:(test command)":              true,
+		"subject:lgtm":                        false,
+		"subject:voilà":                       true,
+		"subject:Voilà":                       true,
+		"Åsa":                                 true,
+		"åsa":                                 true,
+		"list:coreos-dev@googlegroups.com":    true,
+		"{filename:vcs filename:ics}":         true,
+		"has:attachment larger:1K smaller:1M": true,
+		"larger:1M":                           false,
+		"-to:team_mention@noreply.github.com": false,
+		"lgtm OR nope":                        true,
+		"lgtm AND nope":                       false,
+		"older_than:1d newer_than:1m":         true,
+		"after:2026/09/30 before:2026/10/02":  true,
+		"is:unread in:inbox -is:starred":      true,
+		"label:github":                        false,
+		"gmailfil*":                           true,
+		"(from:github.com lgtm) -{spam junk}": true,
+	}
+
+	for q, expected := range testCases {
+		t.Run(q, func(t *testing.T) {
+			n, err := Parse(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := Match(n, msg); got != expected {
+				t.Fatalf("expected match to be %t, got %t", expected, got)
+			}
+		})
+	}
+}
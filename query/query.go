@@ -0,0 +1,326 @@
+// Package query parses Gmail search queries into a syntax tree and lints them
+// for common mistakes.
+package query
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Node is a node in the syntax tree of a query.
+type Node interface {
+	// String returns the node as Gmail search syntax.
+	String() string
+}
+
+// Term is a single word to search for.
+type Term struct {
+	Text string
+	// Exact is true if the term was prefixed with a + to match the word
+	// exactly.
+	Exact bool
+	Pos   int
+}
+
+func (t *Term) String() string {
+	if t.Exact {
+		return "+" + t.Text
+	}
+	return t.Text
+}
+
+// Phrase is a quoted phrase to search for.
+type Phrase struct {
+	Text string
+	Pos  int
+}
+
+func (p *Phrase) String() string {
+	return `"` + p.Text + `"`
+}
+
+// Operator is a search operator like from:, has: or list: and its value.
+type Operator struct {
+	// Name is the name of the operator without the colon.
+	Name  string
+	Value Node
+	Pos   int
+}
+
+func (o *Operator) String() string {
+	return o.Name + ":" + o.Value.String()
+}
+
+// Not matches messages that do not match its node.
+type Not struct {
+	Node Node
+}
+
+func (n *Not) String() string {
+	return "-" + n.Node.String()
+}
+
+// And matches messages that match all of its nodes.
+type And struct {
+	Nodes []Node
+	// Explicit is true if the nodes were joined with AND instead of just
+	// being next to each other.
+	Explicit bool
+}
+
+func (a *And) String() string {
+	sep := " "
+	if a.Explicit {
+		sep = " AND "
+	}
+	return joinNodes(a.Nodes, sep)
+}
+
+// Or matches messages that match any of its nodes.
+type Or struct {
+	Nodes []Node
+	// Braces is true if the nodes were grouped in {} instead of being
+	// joined with OR.
+	Braces bool
+}
+
+func (o *Or) String() string {
+	if o.Braces {
+		return "{" + joinNodes(o.Nodes, " ") + "}"
+	}
+	return joinNodes(o.Nodes, " OR ")
+}
+
+// Group is a parenthesized group.
+type Group struct {
+	Node Node
+}
+
+func (g *Group) String() string {
+	return "(" + g.Node.String() + ")"
+}
+
+func joinNodes(nodes []Node, sep string) string {
+	s := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		s = append(s, n.String())
+	}
+	return strings.Join(s, sep)
+}
+
+// Walk calls fn for the node and all of the nodes under it, depth first.
+func Walk(n Node, fn func(Node)) {
+	if n == nil {
+		return
+	}
+
+	fn(n)
+
+	switch n := n.(type) {
+	case *Operator:
+		Walk(n.Value, fn)
+	case *Not:
+		Walk(n.Node, fn)
+	case *Group:
+		Walk(n.Node, fn)
+	case *And:
+		for _, c := range n.Nodes {
+			Walk(c, fn)
+		}
+	case *Or:
+		for _, c := range n.Nodes {
+			Walk(c, fn)
+		}
+	}
+}
+
+// Parse parses a Gmail search query into a syntax tree. An empty query
+// returns an empty And node.
+func Parse(q string) (Node, error) {
+	toks, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{toks: toks}
+	n, err := p.parseAnd(tokEOF)
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.typ != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// parseAnd parses terms until the end token. Terms next to each other are
+// and-ed together, which binds less tightly than OR.
+func (p *parser) parseAnd(end tokenType) (Node, error) {
+	and := &And{}
+
+	for {
+		t := p.peek()
+		if t.typ == end || t.typ == tokEOF {
+			break
+		}
+
+		switch t.typ {
+		case tokRParen, tokRBrace:
+			return nil, &SyntaxError{Pos: t.pos, Msg: "unbalanced " + t.text}
+		case tokAnd:
+			p.next()
+			if len(and.Nodes) == 0 {
+				return nil, &SyntaxError{Pos: t.pos, Msg: "AND without a term before it"}
+			}
+			if n := p.peek(); n.typ == end || n.typ == tokEOF {
+				return nil, &SyntaxError{Pos: t.pos, Msg: "AND without a term after it"}
+			}
+			and.Explicit = true
+			continue
+		}
+
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		and.Nodes = append(and.Nodes, n)
+	}
+
+	if len(and.Nodes) == 1 {
+		return and.Nodes[0], nil
+	}
+	return and, nil
+}
+
+// parseOr parses terms joined with OR.
+func (p *parser) parseOr() (Node, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	or := &Or{Nodes: []Node{first}}
+	for p.peek().typ == tokOr {
+		t := p.next()
+		switch p.peek().typ {
+		case tokEOF, tokRParen, tokRBrace, tokOr, tokAnd:
+			return nil, &SyntaxError{Pos: t.pos, Msg: "OR without a term after it"}
+		}
+
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		or.Nodes = append(or.Nodes, n)
+	}
+
+	if len(or.Nodes) == 1 {
+		return first, nil
+	}
+	return or, nil
+}
+
+// parseUnary parses a term that might be negated with - or made exact with +.
+func (p *parser) parseUnary() (Node, error) {
+	switch t := p.peek(); t.typ {
+	case tokMinus:
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Node: n}, nil
+	case tokPlus:
+		p.next()
+		n, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if term, ok := n.(*Term); ok {
+			term.Exact = true
+			term.Pos = t.pos
+		}
+		return n, nil
+	}
+
+	return p.parsePrimary()
+}
+
+// operatorRegex matches a word that starts with a search operator.
+var operatorRegex = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*):(.*)$`)
+
+// parsePrimary parses a single term, phrase, operator or group.
+func (p *parser) parsePrimary() (Node, error) {
+	t := p.next()
+
+	switch t.typ {
+	case tokLParen:
+		n, err := p.parseAnd(tokRParen)
+		if err != nil {
+			return nil, err
+		}
+		if p.next().typ != tokRParen {
+			return nil, &SyntaxError{Pos: t.pos, Msg: "unbalanced ("}
+		}
+		return &Group{Node: n}, nil
+	case tokLBrace:
+		n, err := p.parseAnd(tokRBrace)
+		if err != nil {
+			return nil, err
+		}
+		if p.next().typ != tokRBrace {
+			return nil, &SyntaxError{Pos: t.pos, Msg: "unbalanced {"}
+		}
+		// Everything in braces is or-ed together.
+		if and, ok := n.(*And); ok {
+			return &Or{Nodes: and.Nodes, Braces: true}, nil
+		}
+		return &Or{Nodes: []Node{n}, Braces: true}, nil
+	case tokQuoted:
+		return &Phrase{Text: t.text, Pos: t.pos}, nil
+	case tokWord:
+		m := operatorRegex.FindStringSubmatch(t.text)
+		if m == nil {
+			return &Term{Text: t.text, Pos: t.pos}, nil
+		}
+
+		op := &Operator{Name: m[1], Pos: t.pos}
+		if len(m[2]) > 0 {
+			op.Value = &Term{Text: m[2], Pos: t.pos + len(m[1]) + 1}
+			return op, nil
+		}
+
+		// The value has to follow the colon directly, like from:(...).
+		if next := p.peek(); next.pos != t.end || next.typ == tokEOF ||
+			next.typ == tokRParen || next.typ == tokRBrace || next.typ == tokOr || next.typ == tokAnd {
+			return nil, &SyntaxError{Pos: t.pos, Msg: "operator " + t.text + " has no value"}
+		}
+		v, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		op.Value = v
+		return op, nil
+	case tokOr, tokAnd:
+		return nil, &SyntaxError{Pos: t.pos, Msg: t.text + " without a term before it"}
+	case tokRParen, tokRBrace:
+		return nil, &SyntaxError{Pos: t.pos, Msg: "unbalanced " + t.text}
+	}
+
+	return nil, &SyntaxError{Pos: t.pos, Msg: "unexpected end of query"}
+}
@@ -0,0 +1,127 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	testCases := map[string]struct {
+		query    string
+		expected Node
+	}{
+		"non-ASCII terms": {
+			query: "subject:voilà Åsa",
+			expected: &And{Nodes: []Node{
+				&Operator{Name: "subject", Value: &Term{Text: "voilà", Pos: 8}},
+				&Term{Text: "Åsa", Pos: 15},
+			}},
+		},
+		"operator": {
+			query:    "list:coreos-dev@googlegroups.com",
+			expected: &Operator{Name: "list", Value: &Term{Text: "coreos-dev@googlegroups.com", Pos: 5}},
+		},
+		"or binds tighter than and": {
+			query: "from:me to:a OR to:b",
+			expected: &And{Nodes: []Node{
+				&Operator{Name: "from", Value: &Term{Text: "me", Pos: 5}},
+				&Or{Nodes: []Node{
+					&Operator{Name: "to", Value: &Term{Text: "a", Pos: 11}, Pos: 8},
+					&Operator{Name: "to", Value: &Term{Text: "b", Pos: 19}, Pos: 16},
+				}},
+			}},
+		},
+		"negated group value": {
+			query: "from:(-me) {filename:vcs filename:ics}",
+			expected: &And{Nodes: []Node{
+				&Operator{Name: "from", Value: &Group{Node: &Not{Node: &Term{Text: "me", Pos: 7}}}},
+				&Or{Braces: true, Nodes: []Node{
+					&Operator{Name: "filename", Value: &Term{Text: "vcs", Pos: 21}, Pos: 12},
+					&Operator{Name: "filename", Value: &Term{Text: "ics", Pos: 34}, Pos: 25},
+				}},
+			}},
+		},
+		"phrase and exact term": {
+			query: `subject:"Invitation to comment" AND +lgtm`,
+			expected: &And{Explicit: true, Nodes: []Node{
+				&Operator{Name: "subject", Value: &Phrase{Text: "Invitation to comment", Pos: 8}},
+				&Term{Text: "lgtm", Exact: true, Pos: 36},
+			}},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			n, err := Parse(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tc.expected, n); len(diff) > 1 {
+				t.Fatalf("got diff: %s", diff)
+			}
+
+			if n.String() != tc.query {
+				t.Fatalf("expected the query to print as %q, got %q", tc.query, n.String())
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := map[string]string{
+		"(from:me":            "unbalanced ( at column 1",
+		"from:me)":            "unbalanced ) at column 8",
+		"{from:a from:b":      "unbalanced { at column 1",
+		`subject:"lgtm`:       "unterminated quoted phrase at column 9",
+		"from:me OR":          "OR without a term after it at column 9",
+		"OR from:me":          "OR without a term before it at column 1",
+		"from: notifications": "operator from: has no value at column 1",
+		"from:me AND":         "AND without a term after it at column 9",
+	}
+
+	for q, expected := range testCases {
+		t.Run(q, func(t *testing.T) {
+			_, err := Parse(q)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if err.Error() != expected {
+				t.Fatalf("expected error %q, got %q", expected, err.Error())
+			}
+		})
+	}
+}
+
+func TestLint(t *testing.T) {
+	testCases := map[string][]Problem{
+		"from:notifications@github.com LGTM": nil,
+		"form:notifications@github.com": {
+			{Pos: 0, Severity: Warning, Msg: "unknown operator form:, did you mean from:?"},
+		},
+		"tags:foo": {
+			{Pos: 0, Severity: Warning, Msg: "unknown operator tags:, did you mean has:?"},
+		},
+		"foo:bar": {
+			{Pos: 0, Severity: Warning, Msg: "unknown operator foo:"},
+		},
+		"has:attachement": {
+			{Pos: 0, Severity: Warning, Msg: "unknown value attachement for operator has:, did you mean has:attachment?"},
+		},
+		`to:team_mention@noreply.github.com \ -to:mention@noreply.github.com`: {
+			{Pos: 35, Severity: Error, Msg: `stray \, use a multi-line basic string (""") for line continuations`},
+		},
+		"(from:me": {
+			{Pos: 0, Severity: Error, Msg: "unbalanced ("},
+		},
+	}
+
+	for q, expected := range testCases {
+		t.Run(q, func(t *testing.T) {
+			if diff := cmp.Diff(expected, Lint(q)); len(diff) > 1 {
+				t.Fatalf("got diff: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,957 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jessfraz/gmailfilters/query"
+	"github.com/sirupsen/logrus"
+)
+
+// sieveArchive is the mailbox archived mail without a label is filed into,
+// the folder Fastmail and Dovecot use for it.
+const sieveArchive = "Archive"
+
+// sieveWriter converts filters into the rules of a Sieve script (RFC 5228).
+type sieveWriter struct {
+	// me holds the addresses that match me in queries like to:me.
+	me []string
+	// requires holds the extensions the rules use.
+	requires map[string]bool
+}
+
+// encodeSieve writes the filters as a Sieve script. The parts of a filter that
+// have no Sieve equivalent are reported and left out, and a filter with
+// criteria that cannot be converted is skipped, since it would match other
+// mail. It returns the number of filters skipped.
+func encodeSieve(w io.Writer, ff filterfile, me []string) (int, error) {
+	s := sieveWriter{me: me, requires: map[string]bool{}}
+
+	var (
+		rules   []string
+		skipped int
+	)
+	for _, f := range ff.Filter {
+		rule, ok := s.rule(f)
+		if !ok {
+			skipped++
+		}
+		rules = append(rules, rule)
+	}
+
+	var b strings.Builder
+	if len(s.requires) > 0 {
+		var requires []string
+		for ext := range s.requires {
+			requires = append(requires, ext)
+		}
+		sort.Strings(requires)
+		fmt.Fprintf(&b, "require %s;\n", sieveStringList(requires))
+	}
+	for _, rule := range rules {
+		b.WriteString("\n")
+		b.WriteString(rule)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return skipped, err
+}
+
+// rule returns the Sieve rule for a filter, and false if the filter was
+// skipped since its criteria cannot be converted.
+func (s *sieveWriter) rule(f filter) (string, bool) {
+	var b strings.Builder
+	if len(f.Name) > 0 {
+		fmt.Fprintf(&b, "# %s\n", f.Name)
+	}
+
+	test, problems := s.criteria(f)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			untranslatable(&b, f.pos, problem, "skipping the filter")
+		}
+		return b.String(), false
+	}
+
+	actions, problems := s.actions(f)
+	for _, problem := range problems {
+		untranslatable(&b, f.pos, problem, "skipping it")
+	}
+
+	fmt.Fprintf(&b, "if %s {\n", test)
+	for _, action := range actions {
+		fmt.Fprintf(&b, "    %s\n", action)
+	}
+	b.WriteString("}\n")
+	return b.String(), true
+}
+
+// untranslatable reports a construct that cannot be converted, as a warning
+// and as a comment in the script.
+func untranslatable(b *strings.Builder, pos position, construct, what string) {
+	logrus.Warnf("%s: untranslatable construct %s, %s", pos, construct, what)
+	fmt.Fprintf(b, "# untranslatable construct %s, %s\n", construct, what)
+}
+
+// criteria returns the Sieve test for the criteria of a filter.
+func (s *sieveWriter) criteria(f filter) (string, []string) {
+	var (
+		tests    []string
+		problems []string
+	)
+	add := func(test string, p []string) {
+		tests = append(tests, test)
+		problems = append(problems, p...)
+	}
+
+	if len(f.Query) > 0 {
+		add(s.queryTest(f.Query))
+	}
+	if len(f.QueryOr) > 0 {
+		var or []string
+		for _, q := range f.QueryOr {
+			test, p := s.queryTest(q)
+			or = append(or, test)
+			problems = append(problems, p...)
+		}
+		tests = append(tests, sieveTestList("anyof", or))
+	}
+	for _, field := range []struct{ name, value string }{{"from", f.From}, {"to", f.To}, {"subject", f.Subject}} {
+		if len(field.value) < 1 {
+			continue
+		}
+		n, err := query.Parse(field.value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s %q: %v", field.name, field.value, err))
+			continue
+		}
+		add(s.valueTest(field.name, n))
+	}
+	if len(f.NegatedQuery) > 0 {
+		test, p := s.queryTest(f.NegatedQuery)
+		add("not "+test, p)
+	}
+	if f.HasAttachment {
+		problems = append(problems, "hasAttachment")
+	}
+	// Chats never reach a Sieve script, so excludeChats needs no test.
+	if len(f.SizeGreaterThan) > 0 {
+		add(sizeTest(":over", f.SizeGreaterThan))
+	}
+	if len(f.SizeLessThan) > 0 {
+		add(sizeTest(":under", f.SizeLessThan))
+	}
+	if f.ToMe {
+		add(s.keyTest("to", []string{"me"}))
+	}
+
+	return sieveTestList("allof", tests), problems
+}
+
+// queryTest returns the Sieve test for a Gmail query.
+func (s *sieveWriter) queryTest(q string) (string, []string) {
+	n, err := query.Parse(q)
+	if err != nil {
+		return "", []string{fmt.Sprintf("query %q: %v", q, err)}
+	}
+	return s.nodeTest(n)
+}
+
+func (s *sieveWriter) nodeTest(n query.Node) (string, []string) {
+	switch n := n.(type) {
+	case *query.And:
+		return s.nodeTests("allof", n.Nodes)
+	case *query.Or:
+		return s.nodeTests("anyof", n.Nodes)
+	case *query.Not:
+		test, problems := s.nodeTest(n.Node)
+		return "not " + test, problems
+	case *query.Group:
+		return s.nodeTest(n.Node)
+	case *query.Operator:
+		switch name := strings.ToLower(n.Name); name {
+		case "from", "to", "subject", "list":
+			return s.valueTest(name, n.Value)
+		case "larger", "smaller":
+			tag := ":over"
+			if name == "smaller" {
+				tag = ":under"
+			}
+			return sizeTest(tag, n.Value.String())
+		}
+		return "", []string{fmt.Sprintf("operator %q", n.String())}
+	}
+	return "", []string{fmt.Sprintf("search term %q", n.String())}
+}
+
+func (s *sieveWriter) nodeTests(list string, nodes []query.Node) (string, []string) {
+	var (
+		tests    []string
+		problems []string
+	)
+	for _, c := range nodes {
+		test, p := s.nodeTest(c)
+		tests = append(tests, test)
+		problems = append(problems, p...)
+	}
+	return sieveTestList(list, tests), problems
+}
+
+// valueTest returns the Sieve test for the value of an operator, which could
+// be a group like from:(a OR b).
+func (s *sieveWriter) valueTest(name string, value query.Node) (string, []string) {
+	switch v := value.(type) {
+	case *query.Term, *query.Phrase:
+		return s.keyTest(name, []string{valueText(v)})
+	case *query.Group:
+		return s.valueTest(name, v.Node)
+	case *query.Not:
+		test, problems := s.valueTest(name, v.Node)
+		return "not " + test, problems
+	case *query.And, *query.Or:
+		list, nodes := "allof", []query.Node(nil)
+		if and, ok := v.(*query.And); ok {
+			nodes = and.Nodes
+		} else {
+			list, nodes = "anyof", v.(*query.Or).Nodes
+		}
+
+		// Any of a list of keys is a single test.
+		if keys, ok := valueKeys(nodes); ok && (list == "anyof" || len(keys) == 1) {
+			return s.keyTest(name, keys)
+		}
+
+		var (
+			tests    []string
+			problems []string
+		)
+		for _, c := range nodes {
+			test, p := s.valueTest(name, c)
+			tests = append(tests, test)
+			problems = append(problems, p...)
+		}
+		return sieveTestList(list, tests), problems
+	}
+	return "", []string{fmt.Sprintf("operator %q", name+":"+value.String())}
+}
+
+// valueKeys returns the text of the nodes if they are all terms or phrases.
+func valueKeys(nodes []query.Node) ([]string, bool) {
+	var keys []string
+	for _, n := range nodes {
+		switch n.(type) {
+		case *query.Term, *query.Phrase:
+			keys = append(keys, valueText(n))
+		default:
+			return nil, false
+		}
+	}
+	return keys, true
+}
+
+func valueText(n query.Node) string {
+	if p, ok := n.(*query.Phrase); ok {
+		return p.Text
+	}
+	return n.(*query.Term).Text
+}
+
+// keyTest returns the Sieve test matching any of the keys for an operator.
+func (s *sieveWriter) keyTest(name string, keys []string) (string, []string) {
+	for _, key := range keys {
+		if strings.Contains(key, "*") {
+			return "", []string{fmt.Sprintf("wildcard %q", name+":"+key)}
+		}
+	}
+
+	switch name {
+	case "subject":
+		return fmt.Sprintf("header :contains \"subject\" %s", sieveStringList(keys)), nil
+	case "list":
+		// List IDs look like <coreos-dev.googlegroups.com> but they are
+		// searched for like list:coreos-dev@googlegroups.com.
+		ids := make([]string, 0, len(keys))
+		for _, key := range keys {
+			ids = append(ids, strings.Replace(key, "@", ".", -1))
+		}
+		return fmt.Sprintf("header :contains \"list-id\" %s", sieveStringList(ids)), nil
+	}
+
+	// The to: operator matches the To and Cc headers, and me matches our own
+	// addresses, which a Sieve script does not know.
+	headers := `"from"`
+	if name == "to" {
+		headers = `["to", "cc"]`
+	}
+	var (
+		tests []string
+		other []string
+	)
+	for _, key := range keys {
+		if strings.ToLower(key) != "me" {
+			other = append(other, key)
+			continue
+		}
+		if len(s.me) < 1 {
+			return "", []string{fmt.Sprintf("%s:me without the addresses of me, pass them with --me", name)}
+		}
+		tests = append(tests, fmt.Sprintf("address :is %s %s", headers, sieveStringList(s.me)))
+	}
+	if len(other) > 0 {
+		tests = append(tests, fmt.Sprintf("address :contains %s %s", headers, sieveStringList(other)))
+	}
+	return sieveTestList("anyof", tests), nil
+}
+
+// toMeTest returns the Sieve test for to:me.
+func (s *sieveWriter) toMeTest() string {
+	test, _ := s.keyTest("to", []string{"me"})
+	return test
+}
+
+// sizeTest returns the Sieve test for a size like 5MB.
+func sizeTest(tag, size string) (string, []string) {
+	bytes, err := parseSize(size)
+	if err != nil {
+		// Queries leave the B off, as in larger:5M.
+		if bytes, err = parseSize(size + "B"); err != nil {
+			return "", []string{fmt.Sprintf("size %q", size)}
+		}
+	}
+
+	quantity := fmt.Sprintf("%d", bytes)
+	for _, unit := range sizeUnits {
+		if unit.bytes > 1 && bytes%unit.bytes == 0 {
+			quantity = fmt.Sprintf("%d%s", bytes/unit.bytes, unit.suffix[:1])
+			break
+		}
+	}
+	return fmt.Sprintf("size %s %s", tag, quantity), nil
+}
+
+// actions returns the Sieve actions for the actions of a filter.
+func (s *sieveWriter) actions(f filter) ([]string, []string) {
+	var (
+		actions  []string
+		problems []string
+	)
+
+	// The flags must be set before the message is filed anywhere.
+	var flags []string
+	if f.Read {
+		flags = append(flags, `\Seen`)
+	}
+	if f.Star {
+		flags = append(flags, `\Flagged`)
+	}
+	if len(flags) > 0 {
+		s.requires["imap4flags"] = true
+		actions = append(actions, fmt.Sprintf("addflag %s;", sieveStringList(flags)))
+	}
+
+	labels := f.Labels
+	if len(f.Label) > 0 {
+		labels = append([]string{f.Label}, labels...)
+	}
+	for _, label := range labels {
+		s.requires["fileinto"] = true
+		actions = append(actions, fmt.Sprintf("fileinto %s;", sieveString(label)))
+	}
+	if len(f.ForwardTo) > 0 {
+		actions = append(actions, fmt.Sprintf("redirect %s;", sieveString(f.ForwardTo)))
+	}
+
+	// Filing and redirecting a message cancel keeping it in the inbox, which
+	// is what archiving it means.
+	cancelsKeep := len(labels) > 0 || len(f.ForwardTo) > 0
+	switch {
+	case f.Delete:
+		actions = append(actions, "discard;")
+	case f.ArchiveUnlessToMe && len(s.me) < 1:
+		problems = append(problems, "archiveUnlessToMe without the addresses of me, pass them with --me")
+		if cancelsKeep {
+			actions = append(actions, "keep;")
+		}
+	case f.ArchiveUnlessToMe && cancelsKeep:
+		actions = append(actions, fmt.Sprintf("if %s {", s.toMeTest()), "    keep;", "}")
+	case f.ArchiveUnlessToMe:
+		s.requires["fileinto"] = true
+		actions = append(actions, fmt.Sprintf("if not %s {", s.toMeTest()), fmt.Sprintf("    fileinto %s;", sieveString(sieveArchive)), "}")
+	case f.Archive && !cancelsKeep:
+		s.requires["fileinto"] = true
+		actions = append(actions, fmt.Sprintf("fileinto %s;", sieveString(sieveArchive)))
+	case !f.Archive && cancelsKeep:
+		actions = append(actions, "keep;")
+	}
+
+	if f.Important {
+		problems = append(problems, "important")
+	}
+	if f.NeverImportant {
+		problems = append(problems, "neverImportant")
+	}
+	if f.NeverSpam {
+		problems = append(problems, "neverSpam")
+	}
+	if len(f.Category) > 0 {
+		problems = append(problems, fmt.Sprintf("category %q", f.Category))
+	}
+	for _, label := range f.RemoveLabels {
+		problems = append(problems, fmt.Sprintf("removeLabels %q", label))
+	}
+
+	return actions, problems
+}
+
+// sieveTestList joins tests with allof or anyof, unless there is only one.
+func sieveTestList(list string, tests []string) string {
+	switch len(tests) {
+	case 0:
+		return "true"
+	case 1:
+		return tests[0]
+	}
+	return fmt.Sprintf("%s (%s)", list, strings.Join(tests, ", "))
+}
+
+// sieveStringList returns the strings as a Sieve string list, or a single
+// string if there is only one.
+func sieveStringList(s []string) string {
+	if len(s) == 1 {
+		return sieveString(s[0])
+	}
+	quoted := make([]string, 0, len(s))
+	for _, v := range s {
+		quoted = append(quoted, sieveString(v))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+func sieveString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// sieveArg is an argument of a Sieve command or test: a tag like :contains, a
+// number like 5M or a string list.
+type sieveArg struct {
+	tag     string
+	number  string
+	strings []string
+}
+
+// sieveTest is a test like address, allof or not.
+type sieveTest struct {
+	name  string
+	args  []sieveArg
+	tests []sieveTest
+	line  int
+}
+
+// sieveCommand is a command like if or fileinto, and its block.
+type sieveCommand struct {
+	sieveTest
+	block []sieveCommand
+}
+
+// decodeSieve decodes the rules of a Sieve script into filters. Only rules
+// that test the headers the from:, to:, subject: and list: operators search,
+// and the size, can be converted. Anything else is reported and skipped.
+func decodeSieve(file string, data []byte) (filterfile, configLayout, error) {
+	p, err := newSieveParser(string(data))
+	if err != nil {
+		return filterfile{}, configLayout{}, err
+	}
+	commands, err := p.commands(false)
+	if err != nil {
+		return filterfile{}, configLayout{}, err
+	}
+
+	var ff filterfile
+	for _, c := range commands {
+		pos := position{file: file, line: c.line}
+		switch c.name {
+		case "require":
+		case "if":
+			if f, ok := sieveFilter(c, pos); ok {
+				ff.Filter = append(ff.Filter, f)
+			}
+		default:
+			// An elsif or else only runs when the rules before it did not
+			// match, which filters cannot express.
+			logrus.Warnf("%s: untranslatable construct %s, skipping it", pos, c.name)
+		}
+	}
+
+	layout := newConfigLayout()
+	for _, f := range ff.Filter {
+		layout.addBlock("filter", f.pos.line)
+	}
+	return ff, layout, nil
+}
+
+// sieveFilter converts an if rule into a filter. It returns false if the test
+// of the rule cannot be converted.
+func sieveFilter(c sieveCommand, pos position) (filter, bool) {
+	f := filter{pos: pos}
+
+	var (
+		test     = c.tests[0]
+		problems []string
+	)
+	switch test.name {
+	case "allof":
+		var and []string
+		for _, t := range test.tests {
+			q, p := sieveQuery(t)
+			and = append(and, q)
+			problems = append(problems, p...)
+		}
+		f.Query = strings.Join(and, " ")
+	case "anyof":
+		for _, t := range test.tests {
+			q, p := sieveQuery(t)
+			f.QueryOr = append(f.QueryOr, q)
+			problems = append(problems, p...)
+		}
+	default:
+		f.Query, problems = sieveQuery(test)
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			logrus.Warnf("%s: untranslatable construct %s, skipping the rule", pos, problem)
+		}
+		return f, false
+	}
+
+	var (
+		labels      []string
+		archive     bool
+		keep        bool
+		cancelsKeep bool
+	)
+	for _, a := range c.block {
+		// Actions with :copy do not cancel keeping the message.
+		copies := false
+		var values []string
+		for _, arg := range a.args {
+			copies = copies || arg.tag == ":copy"
+			values = append(values, arg.strings...)
+		}
+
+		switch a.name {
+		case "fileinto":
+			cancelsKeep = cancelsKeep || !copies
+			for _, mailbox := range values {
+				if mailbox == sieveArchive {
+					archive = true
+					continue
+				}
+				labels = append(labels, mailbox)
+			}
+		case "addflag":
+			for _, flag := range values {
+				switch strings.ToLower(flag) {
+				case `\seen`:
+					f.Read = true
+				case `\flagged`:
+					f.Star = true
+				default:
+					logrus.Warnf("%s: untranslatable construct flag %q, skipping it", position{file: pos.file, line: a.line}, flag)
+				}
+			}
+		case "redirect":
+			cancelsKeep = cancelsKeep || !copies
+			if len(f.ForwardTo) > 0 || len(values) != 1 {
+				logrus.Warnf("%s: untranslatable construct redirect to more than one address, skipping it", position{file: pos.file, line: a.line})
+				continue
+			}
+			f.ForwardTo = values[0]
+		case "discard":
+			f.Delete = true
+		case "keep":
+			keep = true
+		case "if":
+			// The rules we write archive mail that is not to me by only
+			// keeping it, or only filing it, depending on where it is sent.
+			if isToMeRule(a) {
+				f.ArchiveUnlessToMe = true
+				keep = true
+				continue
+			}
+			logrus.Warnf("%s: untranslatable construct %s, skipping it", position{file: pos.file, line: a.line}, a.name)
+		default:
+			logrus.Warnf("%s: untranslatable construct %s, skipping it", position{file: pos.file, line: a.line}, a.name)
+		}
+	}
+
+	switch len(labels) {
+	case 0:
+	case 1:
+		f.Label = labels[0]
+	default:
+		f.Labels = labels
+	}
+	f.Archive = archive || (cancelsKeep && !keep && !f.Delete)
+
+	return f, true
+}
+
+// isToMeRule reports whether a rule in the block of another is one we write for
+// archiveUnlessToMe, like if address :is ["to", "cc"] "me@example.com" { keep; }.
+func isToMeRule(c sieveCommand) bool {
+	if len(c.block) != 1 {
+		return false
+	}
+
+	test, not := c.tests[0], false
+	if test.name == "not" && len(test.tests) == 1 {
+		test, not = test.tests[0], true
+	}
+	if test.name != "address" {
+		return false
+	}
+	var lists [][]string
+	for _, arg := range test.args {
+		if len(arg.strings) > 0 {
+			lists = append(lists, arg.strings)
+		}
+	}
+	if len(lists) != 2 || sieveHeaders(lists[0]) != "cc to" {
+		return false
+	}
+
+	action := c.block[0]
+	if not {
+		return action.name == "fileinto" && len(action.args) == 1 && reflect.DeepEqual(action.args[0].strings, []string{sieveArchive})
+	}
+	return action.name == "keep"
+}
+
+// sieveQuery converts a Sieve test into a Gmail query.
+func sieveQuery(t sieveTest) (string, []string) {
+	switch t.name {
+	case "allof", "anyof":
+		sep := " "
+		if t.name == "anyof" {
+			sep = " OR "
+		}
+		var (
+			queries  []string
+			problems []string
+		)
+		for _, c := range t.tests {
+			q, p := sieveQuery(c)
+			queries = append(queries, q)
+			problems = append(problems, p...)
+		}
+		return "(" + strings.Join(queries, sep) + ")", problems
+	case "not":
+		if len(t.tests) != 1 {
+			return "", []string{"not test"}
+		}
+		q, problems := sieveQuery(t.tests[0])
+		return "-" + q, problems
+	case "address", "header":
+		return sieveHeaderQuery(t)
+	case "size":
+		if len(t.args) == 2 && len(t.args[1].number) > 0 {
+			switch t.args[0].tag {
+			case ":over":
+				return "larger:" + t.args[1].number, nil
+			case ":under":
+				return "smaller:" + t.args[1].number, nil
+			}
+		}
+		return "", []string{"size test"}
+	}
+	return "", []string{fmt.Sprintf("test %s", t.name)}
+}
+
+// sieveHeaderOperators maps the headers address and header tests match to the
+// operators that search them.
+var sieveHeaderOperators = map[string]string{
+	"from":    "from",
+	"to":      "to",
+	"cc to":   "to",
+	"subject": "subject",
+	"list-id": "list",
+}
+
+// sieveHeaders returns the headers of a test in lower case, sorted and joined
+// with spaces.
+func sieveHeaders(list []string) string {
+	headers := make([]string, 0, len(list))
+	for _, h := range list {
+		headers = append(headers, strings.ToLower(h))
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, " ")
+}
+
+// sieveHeaderQuery converts an address or header test into a Gmail query.
+func sieveHeaderQuery(t sieveTest) (string, []string) {
+	var lists [][]string
+	for i := 0; i < len(t.args); i++ {
+		arg := t.args[i]
+		switch arg.tag {
+		case "":
+			lists = append(lists, arg.strings)
+		case ":is", ":contains", ":all":
+		case ":comparator":
+			// Gmail ignores case like the default comparator.
+			if i+1 < len(t.args) && len(t.args[i+1].strings) == 1 && t.args[i+1].strings[0] == "i;ascii-casemap" {
+				i++
+				continue
+			}
+			return "", []string{fmt.Sprintf("%s test with a comparator", t.name)}
+		default:
+			return "", []string{fmt.Sprintf("%s test with %s", t.name, arg.tag)}
+		}
+	}
+	if len(lists) != 2 {
+		return "", []string{fmt.Sprintf("%s test", t.name)}
+	}
+
+	operator, ok := sieveHeaderOperators[sieveHeaders(lists[0])]
+	if !ok {
+		return "", []string{fmt.Sprintf("%s test of %s", t.name, strings.Join(lists[0], ", "))}
+	}
+
+	values := make([]string, 0, len(lists[1]))
+	for _, key := range lists[1] {
+		if strings.ContainsAny(key, ` ()"{}`) {
+			key = `"` + strings.Replace(key, `"`, "", -1) + `"`
+		}
+		values = append(values, key)
+	}
+	if len(values) == 1 {
+		return operator + ":" + values[0], nil
+	}
+	return operator + ":(" + strings.Join(values, " OR ") + ")", nil
+}
+
+// sieveToken is a token of a Sieve script. Its kind is one of identifier,
+// tag, number, string, or the punctuation itself.
+type sieveToken struct {
+	kind string
+	text string
+	line int
+}
+
+// sieveParser parses the commands of a Sieve script.
+type sieveParser struct {
+	toks []sieveToken
+	pos  int
+}
+
+func newSieveParser(script string) (*sieveParser, error) {
+	var (
+		toks []sieveToken
+		line = 1
+	)
+	for i := 0; i < len(script); {
+		c := script[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(script[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"':
+			var b strings.Builder
+			start := line
+			for i++; ; i++ {
+				if i >= len(script) {
+					return nil, fmt.Errorf("line %d: unterminated string", start)
+				}
+				if script[i] == '\\' && i+1 < len(script) {
+					i++
+				} else if script[i] == '"' {
+					break
+				}
+				if script[i] == '\n' {
+					line++
+				}
+				b.WriteByte(script[i])
+			}
+			i++
+			toks = append(toks, sieveToken{kind: "string", text: b.String(), line: start})
+		case strings.ContainsRune("[](){},;", rune(c)):
+			toks = append(toks, sieveToken{kind: string(c), text: string(c), line: line})
+			i++
+		default:
+			j := i
+			if c == ':' {
+				j++
+			}
+			for j < len(script) && isSieveWordChar(script[j]) {
+				j++
+			}
+			word := script[i:j]
+			if j == i || word == ":" {
+				return nil, fmt.Errorf("line %d: unexpected character %q", line, c)
+			}
+
+			kind := "identifier"
+			switch {
+			case c == ':':
+				kind = "tag"
+			case c >= '0' && c <= '9':
+				kind = "number"
+			case strings.EqualFold(word, "text") && j < len(script) && script[j] == ':':
+				return nil, fmt.Errorf("line %d: multi-line strings are not supported", line)
+			}
+			toks = append(toks, sieveToken{kind: kind, text: strings.ToLower(word), line: line})
+			i = j
+		}
+	}
+	return &sieveParser{toks: toks}, nil
+}
+
+func isSieveWordChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (p *sieveParser) peek() sieveToken {
+	if p.pos >= len(p.toks) {
+		line := 1
+		if len(p.toks) > 0 {
+			line = p.toks[len(p.toks)-1].line
+		}
+		return sieveToken{kind: "end", text: "end of script", line: line}
+	}
+	return p.toks[p.pos]
+}
+
+func (p *sieveParser) expect(kind string) (sieveToken, error) {
+	tok := p.peek()
+	if tok.kind != kind {
+		return tok, fmt.Errorf("line %d: expected %s, got %q", tok.line, kind, tok.text)
+	}
+	p.pos++
+	return tok, nil
+}
+
+// commands parses commands until the end of the script, or of the block.
+func (p *sieveParser) commands(block bool) ([]sieveCommand, error) {
+	var commands []sieveCommand
+	for {
+		tok := p.peek()
+		if (block && tok.kind == "}") || (!block && tok.kind == "end") {
+			return commands, nil
+		}
+		if tok.kind == "end" {
+			return nil, fmt.Errorf("line %d: expected }, got %q", tok.line, tok.text)
+		}
+
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		c := sieveCommand{sieveTest: test}
+
+		switch c.name {
+		case "if", "elsif":
+			if len(c.tests) != 1 {
+				return nil, fmt.Errorf("line %d: %s must have one test", c.line, c.name)
+			}
+		}
+
+		if p.peek().kind == "{" {
+			p.pos++
+			if c.block, err = p.commands(true); err != nil {
+				return nil, err
+			}
+			if _, err := p.expect("}"); err != nil {
+				return nil, err
+			}
+		} else if _, err := p.expect(";"); err != nil {
+			return nil, err
+		}
+		commands = append(commands, c)
+	}
+}
+
+// test parses an identifier and its arguments, which is how both tests and
+// commands start.
+func (p *sieveParser) test() (sieveTest, error) {
+	tok, err := p.expect("identifier")
+	if err != nil {
+		return sieveTest{}, err
+	}
+	t := sieveTest{name: tok.text, line: tok.line}
+
+	for {
+		tok := p.peek()
+		switch tok.kind {
+		case "tag":
+			p.pos++
+			t.args = append(t.args, sieveArg{tag: tok.text})
+			continue
+		case "number":
+			p.pos++
+			t.args = append(t.args, sieveArg{number: strings.ToUpper(tok.text)})
+			continue
+		case "string":
+			p.pos++
+			t.args = append(t.args, sieveArg{strings: []string{tok.text}})
+			continue
+		case "[":
+			p.pos++
+			var list []string
+			for {
+				s, err := p.expect("string")
+				if err != nil {
+					return t, err
+				}
+				list = append(list, s.text)
+				if p.peek().kind != "," {
+					break
+				}
+				p.pos++
+			}
+			if _, err := p.expect("]"); err != nil {
+				return t, err
+			}
+			t.args = append(t.args, sieveArg{strings: list})
+			continue
+		case "(":
+			p.pos++
+			for {
+				c, err := p.test()
+				if err != nil {
+					return t, err
+				}
+				t.tests = append(t.tests, c)
+				if p.peek().kind != "," {
+					break
+				}
+				p.pos++
+			}
+			if _, err := p.expect(")"); err != nil {
+				return t, err
+			}
+		case "identifier":
+			c, err := p.test()
+			if err != nil {
+				return t, err
+			}
+			t.tests = append(t.tests, c)
+		}
+		return t, nil
+	}
+}
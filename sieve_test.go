@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEncodeSieve(t *testing.T) {
+	ff := filterfile{Filter: []filter{
+		{Name: "github", Query: `from:notifications@github.com subject:("pull request" OR review)`, Labels: []string{"github", "github/reviews"}, Read: true},
+		{QueryOr: []string{"list:coreos-dev@googlegroups.com", "from:(a@example.com OR b@example.com)"}, Label: "Mailing Lists/coreos-dev", ArchiveUnlessToMe: true},
+		{From: "newsletter@example.com", SizeGreaterThan: "5MB", Delete: true, ForwardTo: "accounting@example.com", Important: true},
+		{Query: "has:attachment -from:me", Archive: true},
+		{To: "me", Star: true},
+	}}
+
+	var buf bytes.Buffer
+	skipped, err := encodeSieve(&buf, ff, []string{"jess@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 1 {
+		t.Fatalf("expected 1 filter to be skipped, got %d", skipped)
+	}
+
+	expected := `require ["fileinto", "imap4flags"];
+
+# github
+if allof (address :contains "from" "notifications@github.com", header :contains "subject" ["pull request", "review"]) {
+    addflag "\\Seen";
+    fileinto "github";
+    fileinto "github/reviews";
+    keep;
+}
+
+if anyof (header :contains "list-id" "coreos-dev.googlegroups.com", address :contains "from" ["a@example.com", "b@example.com"]) {
+    fileinto "Mailing Lists/coreos-dev";
+    if address :is ["to", "cc"] "jess@example.com" {
+        keep;
+    }
+}
+
+# untranslatable construct important, skipping it
+if allof (address :contains "from" "newsletter@example.com", size :over 5M) {
+    redirect "accounting@example.com";
+    discard;
+}
+
+# untranslatable construct operator "has:attachment", skipping the filter
+
+if address :is ["to", "cc"] "jess@example.com" {
+    addflag "\\Flagged";
+}
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// Without the addresses of me, to:me cannot be converted. Exporting does
+	// not know them either.
+	buf.Reset()
+	skipped, err = encodeFilterfile(&buf, "sieve", filterfile{Filter: ff.Filter[4:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 1 {
+		t.Fatalf("expected 1 filter to be skipped, got %d", skipped)
+	}
+	expected = `
+# untranslatable construct to:me without the addresses of me, pass them with --me, skipping the filter
+`
+	if diff := cmp.Diff(expected, buf.String()); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestDecodeSieve(t *testing.T) {
+	file := writeTestFile(t, "filters.sieve", `require ["fileinto", "imap4flags", "vacation"];
+
+# GitHub
+if allof (address :is :all "From" "notifications@github.com",
+          header :contains "Subject" ["pull request", "review"]) {
+    addflag "\\Seen";
+    fileinto "github";
+    fileinto :copy "github/reviews";
+}
+
+/* Mailing lists */
+if anyof (header :contains "list-id" "coreos-dev.googlegroups.com", address :contains ["to", "cc"] "xdg-app@lists.freedesktop.org") {
+    fileinto "Mailing Lists";
+    if address :is ["to", "cc"] "jess@example.com" {
+        keep;
+    }
+    stop;
+}
+
+if not size :under 5M {
+    redirect "accounting@example.com";
+    discard;
+}
+
+if header :matches "x-spam" "*" {
+    discard;
+}
+elsif exists "x-priority" {
+    fileinto "Archive";
+}
+
+vacation "I am away";
+`)
+
+	filters, err := decodeFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []filter{
+		{Query: `from:notifications@github.com subject:("pull request" OR review)`, Labels: []string{"github", "github/reviews"}, Read: true, Archive: true, pos: position{file: file, line: 4}},
+		{QueryOr: []string{"list:coreos-dev.googlegroups.com", "to:xdg-app@lists.freedesktop.org"}, Label: "Mailing Lists", ArchiveUnlessToMe: true, pos: position{file: file, line: 12}},
+		{Query: "-smaller:5M", ForwardTo: "accounting@example.com", Delete: true, pos: position{file: file, line: 20}},
+	}
+	if diff := cmp.Diff(expected, filters, cmp.AllowUnexported(filter{}, position{})); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestSieveRoundTrip(t *testing.T) {
+	filters := []filter{
+		{Query: "from:builds@travis-ci.org", Label: "builds", Archive: true, Read: true},
+		{Query: "list:coreos-dev.googlegroups.com", Label: "Mailing Lists/coreos-dev", ArchiveUnlessToMe: true},
+		{Query: "to:me subject:invoice", ForwardTo: "accounting@example.com"},
+		{QueryOr: []string{"from:a@example.com", "from:b@example.com"}, Archive: true, Star: true},
+		{Query: "from:spam@example.com", Delete: true},
+	}
+
+	var buf bytes.Buffer
+	if _, err := encodeSieve(&buf, filterfile{Filter: filters}, []string{"jess@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	ff, _, err := decodeSieve("filters.sieve", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ff.Filter {
+		ff.Filter[i].pos = position{}
+	}
+
+	// Sieve does not know which addresses are me.
+	filters[2].Query = "to:jess@example.com subject:invoice"
+	if diff := cmp.Diff(filters, ff.Filter, cmp.AllowUnexported(filter{}, position{})); len(diff) > 1 {
+		t.Fatalf("got diff: %s\nscript:\n%s", diff, buf.String())
+	}
+}
+
+func TestSieveSyntaxErrors(t *testing.T) {
+	testCases := map[string]string{
+		"if true {\n    keep;\n":           "line 2: expected }, got \"end of script\"",
+		"if true {\n    keep\n}":           "line 3: expected ;, got \"}\"",
+		"if header :contains \"a\n":        "line 1: unterminated string",
+		"/* comment":                       "line 1: unterminated comment",
+		"vacation text:\nI am away\n.\n;":  "line 1: multi-line strings are not supported",
+		"if true {\n    fileinto [];\n}\n": "line 2: expected string, got \"]\"",
+	}
+
+	for script, expected := range testCases {
+		_, _, err := decodeSieve("filters.sieve", []byte(script))
+		if err == nil || err.Error() != expected {
+			t.Errorf("%q: expected error %q, got %v", script, expected, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/gmail/v1"
+)
+
+// filterDiff holds the changes needed to make the filters on an account match
+// the filters from a config file.
+type filterDiff struct {
+	// labels holds the names of the labels that need to be created, this is
+	// only set when planning against a dryRunBackend since otherwise they are
+	// created as the filters are converted.
+	labels    []string
+	create    []gmail.Filter
+	delete    []*gmail.Filter
+	unchanged int
+}
+
+// planSync computes the changes needed to make the filters on the account
+// match the filters passed without changing any filters.
+func planSync(b backend, filters []filter) (filterDiff, error) {
+	labels, err := getLabelMap(b)
+	if err != nil {
+		return filterDiff{}, err
+	}
+
+	// Convert all our filters before we change anything on the account so
+	// an invalid filter does not leave us in a half synced state.
+	desired := []gmail.Filter{}
+	for _, f := range filters {
+		gmailFilters, err := f.toGmailFilters(&labels)
+		if err != nil {
+			return filterDiff{}, fmt.Errorf("%s: %v", f.pos, err)
+		}
+		desired = append(desired, gmailFilters...)
+	}
+
+	// Get current filters for the user.
+	existing, err := b.ListFilters()
+	if err != nil {
+		return filterDiff{}, fmt.Errorf("listing filters failed: %v", err)
+	}
+
+	diff := diffFilters(existing, desired)
+
+	// Add any labels we would have created.
+	for _, id := range labels.ids {
+		if name, ok := plannedLabelName(id); ok {
+			diff.labels = append(diff.labels, name)
+		}
+	}
+	sort.Strings(diff.labels)
+
+	return diff, nil
+}
+
+// syncFilters makes the filters on the account match the filters passed.
+// Only the missing filters are created and only the stale filters are deleted,
+// filters that are already correct are not touched. If a change fails the diff
+// returned holds the changes that were made before it.
+func syncFilters(b backend, filters []filter) (filterDiff, error) {
+	diff, err := planSync(b, filters)
+	if err != nil {
+		return filterDiff{}, err
+	}
+	applied := filterDiff{labels: diff.labels, unchanged: diff.unchanged}
+
+	// Create the missing filters first, that way if something fails the
+	// account still has all of its old filters.
+	for _, fltr := range diff.create {
+		logrus.WithFields(logrus.Fields{
+			"action":   fmt.Sprintf("%#v", fltr.Action),
+			"criteria": fmt.Sprintf("%#v", fltr.Criteria),
+		}).Debug("adding Gmail filter")
+		if _, err := b.CreateFilter(&fltr); err != nil {
+			return applied, fmt.Errorf("creating filter [%#v] failed: %v", fltr, err)
+		}
+		applied.create = append(applied.create, fltr)
+	}
+
+	// Delete the stale filters.
+	for _, fltr := range diff.delete {
+		logrus.WithFields(logrus.Fields{
+			"id":       fltr.Id,
+			"action":   fmt.Sprintf("%#v", fltr.Action),
+			"criteria": fmt.Sprintf("%#v", fltr.Criteria),
+		}).Debug("deleting Gmail filter")
+		if err := b.DeleteFilter(fltr.Id); err != nil {
+			return applied, fmt.Errorf("deleting filter id %s failed: %v", fltr.Id, err)
+		}
+		applied.delete = append(applied.delete, fltr)
+	}
+
+	return applied, nil
+}
+
+// diffFilters matches the existing filters against the desired filters by
+// their normalized criteria and action.
+func diffFilters(existing []*gmail.Filter, desired []gmail.Filter) filterDiff {
+	// Index the existing filters on their key. We could have duplicates on
+	// the account so keep all of them.
+	current := map[string][]*gmail.Filter{}
+	for _, f := range existing {
+		key := filterKey(f)
+		current[key] = append(current[key], f)
+	}
+
+	var diff filterDiff
+	keep := map[*gmail.Filter]bool{}
+	seen := map[string]bool{}
+	for _, f := range desired {
+		f := f
+		key := filterKey(&f)
+		if seen[key] {
+			// We already have this filter from the config file.
+			continue
+		}
+		seen[key] = true
+
+		if matches := current[key]; len(matches) > 0 {
+			// The filter already exists, keep the first one and leave the
+			// duplicates to be deleted.
+			keep[matches[0]] = true
+			diff.unchanged++
+			continue
+		}
+
+		diff.create = append(diff.create, f)
+	}
+
+	// Whatever we did not keep on the account is stale.
+	for _, f := range existing {
+		if !keep[f] {
+			diff.delete = append(diff.delete, f)
+		}
+	}
+
+	return diff
+}
+
+// normalizedFilter is the comparable form of a Gmail filter.
+type normalizedFilter struct {
+	From           string
+	To             string
+	Subject        string
+	Query          string
+	NegatedQuery   string
+	HasAttachment  bool
+	ExcludeChats   bool
+	Size           int64
+	SizeComparison string
+
+	AddLabelIds    []string
+	RemoveLabelIds []string
+	Forward        string
+}
+
+// filterKey returns a key for a Gmail filter that is the same for any two
+// filters with equivalent criteria and action.
+func filterKey(f *gmail.Filter) string {
+	var n normalizedFilter
+
+	if c := f.Criteria; c != nil {
+		n.From = normalizeAddress(c.From)
+		n.To = normalizeAddress(c.To)
+		n.Subject = normalizeQuery(c.Subject)
+		n.Query = normalizeQuery(c.Query)
+		n.NegatedQuery = normalizeQuery(c.NegatedQuery)
+		n.HasAttachment = c.HasAttachment
+		n.ExcludeChats = c.ExcludeChats
+		if c.Size > 0 {
+			n.Size = c.Size
+			n.SizeComparison = strings.ToLower(c.SizeComparison)
+		}
+	}
+
+	if a := f.Action; a != nil {
+		n.AddLabelIds = sortedUnique(a.AddLabelIds)
+		n.RemoveLabelIds = sortedUnique(a.RemoveLabelIds)
+		n.Forward = normalizeAddress(a.Forward)
+	}
+
+	b, _ := json.Marshal(n)
+	return string(b)
+}
+
+// normalizeQuery collapses all the whitespace in a query.
+func normalizeQuery(q string) string {
+	return strings.Join(strings.Fields(q), " ")
+}
+
+// normalizeAddress collapses the whitespace and lowers the case of an
+// address.
+func normalizeAddress(s string) string {
+	return strings.ToLower(normalizeQuery(s))
+}
+
+func sortedUnique(s []string) []string {
+	m := map[string]bool{}
+	out := []string{}
+	for _, v := range s {
+		if !m[v] {
+			m[v] = true
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
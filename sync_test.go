@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestDiffFilters(t *testing.T) {
+	archive := gmail.Filter{
+		Action: &gmail.FilterAction{
+			RemoveLabelIds: []string{"INBOX", "UNREAD"},
+		},
+		Criteria: &gmail.FilterCriteria{
+			Query: "to:your_activity@noreply.github.com",
+		},
+	}
+	label := gmail.Filter{
+		Action: &gmail.FilterAction{
+			AddLabelIds: []string{"1"},
+		},
+		Criteria: &gmail.FilterCriteria{
+			Query: "from:notifications@github.com LGTM",
+		},
+	}
+
+	testCases := map[string]struct {
+		existing  []*gmail.Filter
+		desired   []gmail.Filter
+		create    []string
+		delete    []string
+		unchanged int
+	}{
+		"empty account": {
+			desired: []gmail.Filter{archive, label},
+			create:  []string{archive.Criteria.Query, label.Criteria.Query},
+		},
+		"nothing changed": {
+			existing: []*gmail.Filter{
+				{
+					Id: "a",
+					Action: &gmail.FilterAction{
+						RemoveLabelIds: []string{"UNREAD", "INBOX"},
+					},
+					Criteria: &gmail.FilterCriteria{
+						Query: "to:your_activity@noreply.github.com ",
+					},
+				},
+				{Id: "b", Action: label.Action, Criteria: label.Criteria},
+			},
+			desired:   []gmail.Filter{archive, label},
+			unchanged: 2,
+		},
+		"stale and missing": {
+			existing: []*gmail.Filter{
+				{Id: "a", Action: archive.Action, Criteria: archive.Criteria},
+				{
+					Id:       "b",
+					Action:   &gmail.FilterAction{AddLabelIds: []string{"2"}},
+					Criteria: label.Criteria,
+				},
+			},
+			desired:   []gmail.Filter{archive, label},
+			create:    []string{label.Criteria.Query},
+			delete:    []string{"b"},
+			unchanged: 1,
+		},
+		"duplicates": {
+			existing: []*gmail.Filter{
+				{Id: "a", Action: archive.Action, Criteria: archive.Criteria},
+				{Id: "b", Action: archive.Action, Criteria: archive.Criteria},
+			},
+			desired:   []gmail.Filter{archive, archive},
+			delete:    []string{"b"},
+			unchanged: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			diff := diffFilters(tc.existing, tc.desired)
+
+			if len(diff.create) != len(tc.create) {
+				t.Fatalf("expected %d filters to create, got %d", len(tc.create), len(diff.create))
+			}
+			for i, f := range diff.create {
+				if f.Criteria.Query != tc.create[i] {
+					t.Fatalf("expected filter %q to be created, got %q", tc.create[i], f.Criteria.Query)
+				}
+			}
+
+			if len(diff.delete) != len(tc.delete) {
+				t.Fatalf("expected %d filters to delete, got %d", len(tc.delete), len(diff.delete))
+			}
+			for i, f := range diff.delete {
+				if f.Id != tc.delete[i] {
+					t.Fatalf("expected filter %s to be deleted, got %s", tc.delete[i], f.Id)
+				}
+			}
+
+			if diff.unchanged != tc.unchanged {
+				t.Fatalf("expected %d unchanged filters, got %d", tc.unchanged, diff.unchanged)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jessfraz/gmailfilters/query"
+	"google.golang.org/api/gmail/v1"
+)
+
+const testHelp = `Test which filters match sample emails without making any API calls.`
+
+const testLongHelp = testHelp + `
+
+Messages are RFC 822 (.eml) files or directories of them. The queries are
+matched with a local approximation of Gmail search.`
+
+func (cmd *testCommand) Name() string      { return "test" }
+func (cmd *testCommand) Args() string      { return "FILE MESSAGE..." }
+func (cmd *testCommand) ShortHelp() string { return testHelp }
+func (cmd *testCommand) LongHelp() string  { return testLongHelp }
+func (cmd *testCommand) Hidden() bool      { return false }
+
+func (cmd *testCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.me, "me", "", "comma separated addresses that match me in queries like to:me")
+}
+
+type testCommand struct {
+	me string
+}
+
+func (cmd *testCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errors.New("must pass a path to a gmail filter configuration file and at least one message")
+	}
+
+	filters, err := decodeFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	messages, err := loadMessageFiles(args[1:])
+	if err != nil {
+		return err
+	}
+
+	var me []string
+	for _, addr := range strings.Split(cmd.me, ",") {
+		if addr = strings.TrimSpace(addr); len(addr) > 0 {
+			me = append(me, addr)
+		}
+	}
+
+	s, err := newSimulator(filters)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range messages {
+		m.msg.Me = me
+
+		result := s.run(m.msg)
+
+		fmt.Printf("%s:\n", m.name)
+		printSimulation(os.Stdout, result)
+	}
+
+	return nil
+}
+
+// simulation is the result of running filters on a message.
+type simulation struct {
+	// matches are the positions of the filters that matched.
+	matches []position
+	// action is all of the actions of the filters that matched.
+	action gmail.FilterAction
+	// names maps label IDs to their names.
+	names map[string]string
+}
+
+// simulator matches messages against filters. The filters are converted with
+// an empty in memory account, so no API calls are made, and the queries of
+// the criteria they produce are parsed once up front.
+type simulator struct {
+	rules []simulatorRule
+	// names maps label IDs to their names.
+	names map[string]string
+}
+
+// simulatorRule is one of the Gmail filters a filter was converted to.
+type simulatorRule struct {
+	pos    position
+	query  query.Node
+	action *gmail.FilterAction
+}
+
+// newSimulator converts the filters so messages can be matched against them.
+func newSimulator(filters []filter) (*simulator, error) {
+	// Labels are only planned so nothing is created, not even in memory.
+	b := dryRunBackend{newMemoryBackend()}
+	labels, err := getLabelMap(b)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &simulator{}
+	for _, f := range filters {
+		gfs, err := f.toGmailFilters(&labels)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.pos, err)
+		}
+
+		for _, gf := range gfs {
+			if gf.Criteria == nil {
+				continue
+			}
+			n, err := query.Parse(criteriaQuery(gf.Criteria))
+			if err != nil {
+				return nil, fmt.Errorf("%s: parsing query failed: %v", f.pos, err)
+			}
+			s.rules = append(s.rules, simulatorRule{pos: f.pos, query: n, action: gf.Action})
+		}
+	}
+
+	s.names, err = getLabelMapOnID(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// run finds the filters that match a message and what they do to it.
+func (s *simulator) run(msg *query.Message) simulation {
+	result := simulation{names: s.names}
+	for _, r := range s.rules {
+		if !query.Match(r.query, msg) {
+			continue
+		}
+
+		if len(result.matches) == 0 || result.matches[len(result.matches)-1] != r.pos {
+			result.matches = append(result.matches, r.pos)
+		}
+		if a := r.action; a != nil {
+			for _, id := range a.AddLabelIds {
+				result.action.AddLabelIds = appendUnique(result.action.AddLabelIds, id)
+			}
+			for _, id := range a.RemoveLabelIds {
+				result.action.RemoveLabelIds = appendUnique(result.action.RemoveLabelIds, id)
+			}
+			if len(a.Forward) > 0 {
+				result.action.Forward = a.Forward
+			}
+		}
+	}
+	return result
+}
+
+// criteriaQuery turns the criteria of a Gmail filter into a single search
+// query, the same way Gmail does when searching for the messages a filter
+// matches.
+func criteriaQuery(c *gmail.FilterCriteria) string {
+	var q []string
+	if len(c.From) > 0 {
+		q = append(q, "from:("+c.From+")")
+	}
+	if len(c.To) > 0 {
+		q = append(q, "to:("+c.To+")")
+	}
+	if len(c.Subject) > 0 {
+		q = append(q, "subject:("+c.Subject+")")
+	}
+	if len(c.Query) > 0 {
+		q = append(q, "("+c.Query+")")
+	}
+	if len(c.NegatedQuery) > 0 {
+		q = append(q, "-("+c.NegatedQuery+")")
+	}
+	if c.HasAttachment {
+		q = append(q, "has:attachment")
+	}
+	if c.Size > 0 {
+		if c.SizeComparison == "smaller" {
+			q = append(q, fmt.Sprintf("smaller:%d", c.Size))
+		} else {
+			q = append(q, fmt.Sprintf("larger:%d", c.Size))
+		}
+	}
+	return strings.Join(q, " ")
+}
+
+// printSimulation prints the filters that matched a message and what they
+// would do to it.
+func printSimulation(w io.Writer, result simulation) {
+	if len(result.matches) == 0 {
+		fmt.Fprint(w, "  no filters match\n\n")
+		return
+	}
+
+	for _, pos := range result.matches {
+		fmt.Fprintf(w, "  matches %s\n", pos)
+	}
+
+	name := func(id string) string {
+		if name, ok := plannedLabelName(id); ok {
+			return name
+		}
+		return labelName(result.names, id)
+	}
+
+	var labels, actions []string
+	for _, id := range result.action.AddLabelIds {
+		switch {
+		case id == "TRASH":
+			actions = append(actions, "delete")
+		case id == "STARRED":
+			actions = append(actions, "star")
+		case id == "IMPORTANT":
+			actions = append(actions, "mark as important")
+		case strings.HasPrefix(id, "CATEGORY_"):
+			actions = append(actions, "categorize as "+categoryName(id))
+		default:
+			labels = append(labels, quote(name(id)))
+		}
+	}
+	for _, id := range result.action.RemoveLabelIds {
+		switch id {
+		case "INBOX":
+			actions = append(actions, "archive")
+		case "UNREAD":
+			actions = append(actions, "mark as read")
+		case "IMPORTANT":
+			actions = append(actions, "never mark as important")
+		case "SPAM":
+			actions = append(actions, "never send to spam")
+		default:
+			actions = append(actions, "remove label "+quote(name(id)))
+		}
+	}
+	if len(result.action.Forward) > 0 {
+		actions = append(actions, "forward to "+result.action.Forward)
+	}
+
+	if len(labels) > 0 {
+		fmt.Fprintf(w, "  %-9s %s\n", "labels:", strings.Join(labels, ", "))
+	}
+	if len(actions) > 0 {
+		fmt.Fprintf(w, "  %-9s %s\n", "actions:", strings.Join(actions, ", "))
+	}
+	fmt.Fprintln(w)
+}
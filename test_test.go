@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSimulateFilters(t *testing.T) {
+	config := writeTestFile(t, "filters.toml", `[[filter]]
+query = "from:notifications@github.com LGTM"
+labels = ["github", "github/LGTM"]
+
+[[filter]]
+query = "list:coreos-dev@googlegroups.com"
+archiveUnlessToMe = true
+read = true
+
+[[filter]]
+from = "notifications@github.com"
+subject = "security"
+star = true
+forwardTo = "security@example.com"
+
+[[filter]]
+query = "has:attachment"
+sizeGreaterThan = "5MB"
+delete = true
+`)
+
+	eml := writeTestFile(t, "lgtm.eml", "From: GitHub <notifications@github.com>\r\n"+
+		"To: coreos-dev@googlegroups.com\r\n"+
+		"List-Id: <coreos-dev.googlegroups.com>\r\n"+
+		"Subject: =?UTF-8?Q?Re:_Fix_the_security_=E2=9C=94?=\r\n"+
+		"Content-Type: multipart/mixed; boundary=b\r\n"+
+		"\r\n"+
+		"--b\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Transfer-Encoding: base64\r\n"+
+		"\r\n"+
+		"TEdUTSwgdGhhbmtzIQ==\r\n"+
+		"--b\r\n"+
+		"Content-Type: application/pdf\r\n"+
+		"Content-Disposition: attachment; filename=\"report.pdf\"\r\n"+
+		"\r\n"+
+		"%PDF\r\n"+
+		"--b--\r\n")
+
+	filters, err := decodeFile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := loadMessageFiles([]string{filepath.Dir(eml)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	if diff := cmp.Diff([]string{"report.pdf"}, messages[0].msg.Filenames); len(diff) > 1 {
+		t.Fatalf("filenames differ: %s", diff)
+	}
+
+	s, err := newSimulator(filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := s.run(messages[0].msg)
+
+	var out bytes.Buffer
+	printSimulation(&out, result)
+
+	expected := `  matches ` + config + `:1
+  matches ` + config + `:5
+  matches ` + config + `:10
+  labels:   "github", "github/LGTM"
+  actions:  star, mark as read, archive, forward to security@example.com
+
+`
+	if diff := cmp.Diff(expected, out.String()); len(diff) > 1 {
+		t.Fatalf("output differs: %s", diff)
+	}
+
+	// The message is not to me so it is archived, but it would not be if it
+	// was.
+	messages[0].msg.Me = []string{"coreos-dev@googlegroups.com"}
+	result = s.run(messages[0].msg)
+	if diff := cmp.Diff([]string{"UNREAD"}, result.action.RemoveLabelIds); len(diff) > 1 {
+		t.Fatalf("removed labels differ: %s", diff)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+// tokenStore stores OAuth tokens keyed by account, so the tokens of several
+// accounts can be kept at once. Get returns an error for which os.IsNotExist
+// is true if there is no token for the account.
+type tokenStore interface {
+	// Get returns the token for the account.
+	Get(account string) (*oauth2.Token, error)
+	// Put saves the token for the account.
+	Put(account string, tok *oauth2.Token) error
+	// Delete deletes the token for the account.
+	Delete(account string) error
+}
+
+// newTokenStore returns the token store for the kind passed, which is file,
+// encrypted or exec:COMMAND. Token files are kept in dir unless file is set,
+// in which case that one file is used for every account.
+func newTokenStore(kind, dir, file string) (tokenStore, error) {
+	if len(dir) < 1 {
+		d, err := defaultTokenDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = d
+	}
+	files := &fileTokenStore{dir: dir, file: file}
+
+	switch {
+	case kind == "file":
+		return files, nil
+	case kind == "encrypted":
+		var c tokenCipher
+		if identity := os.Getenv("GMAILFILTERS_AGE_IDENTITY"); len(identity) > 0 {
+			c = ageCipher{identity: identity}
+		} else if passphrase := os.Getenv("GMAILFILTERS_TOKEN_PASSPHRASE"); len(passphrase) > 0 {
+			c = passphraseCipher{passphrase: passphrase}
+		} else {
+			return nil, errors.New("the encrypted token store needs GMAILFILTERS_TOKEN_PASSPHRASE or GMAILFILTERS_AGE_IDENTITY to be set")
+		}
+		files.ext = ".enc"
+		return &encryptedTokenStore{files: files, cipher: c}, nil
+	case strings.HasPrefix(kind, "exec:"):
+		command := strings.TrimSpace(strings.TrimPrefix(kind, "exec:"))
+		if len(command) < 1 {
+			return nil, errors.New("the exec token store needs a command, like exec:COMMAND")
+		}
+		return execTokenStore{command: command}, nil
+	}
+
+	return nil, fmt.Errorf("unknown token store %q, must be file, encrypted or exec:COMMAND", kind)
+}
+
+// defaultTokenDir returns the directory tokens are kept in by default, which
+// is in the user's config directory, like $XDG_CONFIG_HOME/gmailfilters/tokens.
+func defaultTokenDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("finding config directory failed: %v", err)
+	}
+	return filepath.Join(dir, "gmailfilters", "tokens"), nil
+}
+
+// fileTokenStore keeps each token in a file only the user can read.
+type fileTokenStore struct {
+	dir string
+	// file is used for every account if it is set.
+	file string
+	// ext is added to the name of each token file.
+	ext string
+}
+
+// path returns the path of the token file for the account.
+func (s *fileTokenStore) path(account string) string {
+	if len(s.file) > 0 {
+		return s.file
+	}
+	return filepath.Join(s.dir, url.PathEscape(account)+".json"+s.ext)
+}
+
+// read reads the token file for the account. It refuses to read files other
+// users can access, since the token gives access to the account.
+func (s *fileTokenStore) read(account string) ([]byte, error) {
+	file := s.path(account)
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("token file %s can be accessed by other users, fix it with: chmod 600 %s", file, file)
+	}
+
+	return ioutil.ReadFile(file)
+}
+
+// write writes the token file for the account. The data is written to a
+// temporary file that is renamed over the file, so the file is never left
+// half written.
+func (s *fileTokenStore) write(account string, data []byte) error {
+	file := s.path(account)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return fmt.Errorf("creating token directory failed: %v", err)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+
+	if err := os.Rename(f.Name(), file); err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	return nil
+}
+
+// Get returns the token for the account.
+func (s *fileTokenStore) Get(account string) (*oauth2.Token, error) {
+	b, err := s.read(account)
+	if err != nil {
+		return nil, err
+	}
+	return decodeToken(b)
+}
+
+// Put saves the token for the account.
+func (s *fileTokenStore) Put(account string, tok *oauth2.Token) error {
+	logrus.Debugf("Saving token file to: %s", s.path(account))
+
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	return s.write(account, b)
+}
+
+// Delete deletes the token for the account.
+func (s *fileTokenStore) Delete(account string) error {
+	return os.Remove(s.path(account))
+}
+
+// tokenCipher encrypts and decrypts tokens.
+type tokenCipher interface {
+	encrypt(plaintext []byte) ([]byte, error)
+	decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// encryptedTokenStore keeps each token encrypted in a file.
+type encryptedTokenStore struct {
+	files  *fileTokenStore
+	cipher tokenCipher
+}
+
+// Get returns the token for the account.
+func (s *encryptedTokenStore) Get(account string) (*oauth2.Token, error) {
+	b, err := s.files.read(account)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err = s.cipher.decrypt(b)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting token file %s failed: %v", s.files.path(account), err)
+	}
+	return decodeToken(b)
+}
+
+// Put saves the token for the account.
+func (s *encryptedTokenStore) Put(account string, tok *oauth2.Token) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+
+	b, err = s.cipher.encrypt(b)
+	if err != nil {
+		return fmt.Errorf("encrypting token failed: %v", err)
+	}
+	return s.files.write(account, b)
+}
+
+// Delete deletes the token for the account.
+func (s *encryptedTokenStore) Delete(account string) error {
+	return s.files.Delete(account)
+}
+
+// passphraseCipher encrypts with AES-GCM using a key derived from a
+// passphrase with scrypt. The random salt and nonce are stored before the
+// ciphertext.
+type passphraseCipher struct {
+	passphrase string
+}
+
+const (
+	passphraseSaltSize = 16
+	passphraseMagic    = "gmailfilters-scrypt-v1\n"
+)
+
+func (c passphraseCipher) aead(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(c.passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c passphraseCipher) encrypt(plaintext []byte) ([]byte, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(passphraseMagic), salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, []byte(passphraseMagic)), nil
+}
+
+func (c passphraseCipher) decrypt(ciphertext []byte) ([]byte, error) {
+	if !bytes.HasPrefix(ciphertext, []byte(passphraseMagic)) {
+		return nil, errors.New("not a passphrase encrypted token")
+	}
+	ciphertext = ciphertext[len(passphraseMagic):]
+	if len(ciphertext) < passphraseSaltSize {
+		return nil, errors.New("encrypted token is too short")
+	}
+
+	aead, err := c.aead(ciphertext[:passphraseSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	ciphertext = ciphertext[passphraseSaltSize:]
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("encrypted token is too short")
+	}
+
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], []byte(passphraseMagic))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or the token file is corrupt")
+	}
+	return plaintext, nil
+}
+
+// ageCipher encrypts with the age command line tool to the recipient of an
+// age identity file.
+type ageCipher struct {
+	identity string
+}
+
+func (c ageCipher) encrypt(plaintext []byte) ([]byte, error) {
+	recipient, err := runCommand(exec.Command("age-keygen", "-y", c.identity), nil)
+	if err != nil {
+		return nil, err
+	}
+	return runCommand(exec.Command("age", "--encrypt", "--recipient", strings.TrimSpace(string(recipient))), plaintext)
+}
+
+func (c ageCipher) decrypt(ciphertext []byte) ([]byte, error) {
+	return runCommand(exec.Command("age", "--decrypt", "--identity", c.identity), ciphertext)
+}
+
+// execTokenStore asks a helper command for tokens, in the style of git
+// credential helpers. The command is run by the shell with get, store or
+// erase as its argument. It is passed the account, and for store the token
+// as JSON, as key=value lines on stdin:
+//
+//	account=you@example.com
+//	token={"access_token":"...","refresh_token":"..."}
+//
+// For get it prints the token line, or nothing if it has no token.
+type execTokenStore struct {
+	command string
+}
+
+func (s execTokenStore) run(action string, attrs map[string]string) (map[string]string, error) {
+	var in bytes.Buffer
+	for _, key := range []string{"account", "token"} {
+		if v, ok := attrs[key]; ok {
+			fmt.Fprintf(&in, "%s=%s\n", key, v)
+		}
+	}
+	in.WriteString("\n")
+
+	out, err := runCommand(exec.Command("sh", "-c", s.command+" "+action), in.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("token helper %s failed: %v", action, err)
+	}
+
+	result := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if kv := strings.SplitN(scanner.Text(), "=", 2); len(kv) == 2 {
+			result[kv[0]] = kv[1]
+		}
+	}
+	return result, scanner.Err()
+}
+
+// Get returns the token for the account.
+func (s execTokenStore) Get(account string) (*oauth2.Token, error) {
+	result, err := s.run("get", map[string]string{"account": account})
+	if err != nil {
+		return nil, err
+	}
+
+	tok, ok := result["token"]
+	if !ok || len(tok) < 1 {
+		return nil, os.ErrNotExist
+	}
+	return decodeToken([]byte(tok))
+}
+
+// Put saves the token for the account.
+func (s execTokenStore) Put(account string, tok *oauth2.Token) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	_, err = s.run("store", map[string]string{"account": account, "token": string(b)})
+	return err
+}
+
+// Delete deletes the token for the account.
+func (s execTokenStore) Delete(account string) error {
+	_, err := s.run("erase", map[string]string{"account": account})
+	return err
+}
+
+// runCommand runs a command with the input passed on stdin and returns its
+// output. Errors include what the command printed to stderr.
+func runCommand(cmd *exec.Cmd, input []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); len(msg) > 0 {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// decodeToken decodes a token saved as JSON.
+func decodeToken(b []byte) (*oauth2.Token, error) {
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(b, tok); err != nil {
+		return nil, fmt.Errorf("decoding token failed: %v", err)
+	}
+	return tok, nil
+}
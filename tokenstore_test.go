@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenHelper is a token helper that keeps tokens in files next to it.
+const tokenHelper = `#!/bin/sh
+account=; token=
+while IFS= read -r line && [ -n "$line" ]; do
+	case "$line" in
+		account=*) account="${line#account=}" ;;
+		token=*) token="${line#token=}" ;;
+	esac
+done
+file="$(dirname "$0")/$account.token"
+case "$1" in
+	get) [ -f "$file" ] && printf 'token=%s\n' "$(cat "$file")" ;;
+	store) printf '%s' "$token" > "$file" ;;
+	erase) rm -f "$file" ;;
+esac
+exit 0
+`
+
+func TestTokenStores(t *testing.T) {
+	testCases := map[string]func(t *testing.T, dir string) tokenStore{
+		"file": func(t *testing.T, dir string) tokenStore {
+			return &fileTokenStore{dir: dir}
+		},
+		"encrypted": func(t *testing.T, dir string) tokenStore {
+			return &encryptedTokenStore{
+				files:  &fileTokenStore{dir: dir, ext: ".enc"},
+				cipher: passphraseCipher{passphrase: "correct horse battery staple"},
+			}
+		},
+		"exec": func(t *testing.T, dir string) tokenStore {
+			helper := filepath.Join(dir, "helper")
+			if err := ioutil.WriteFile(helper, []byte(tokenHelper), 0700); err != nil {
+				t.Fatal(err)
+			}
+			return execTokenStore{command: helper}
+		},
+	}
+
+	for name, newStore := range testCases {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t, filepath.Dir(writeTestFile(t, "README", "")))
+
+			if _, err := store.Get("me@example.com"); !os.IsNotExist(err) {
+				t.Fatalf("expected a not exist error for a missing token, got %v", err)
+			}
+
+			// Tokens for different accounts are kept apart.
+			for _, account := range []string{"me@example.com", "me+work@example.com"} {
+				if err := store.Put(account, &oauth2.Token{AccessToken: "access " + account, RefreshToken: "refresh"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, account := range []string{"me@example.com", "me+work@example.com"} {
+				tok, err := store.Get(account)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tok.AccessToken != "access "+account || tok.RefreshToken != "refresh" {
+					t.Fatalf("unexpected token for %s: %#v", account, tok)
+				}
+			}
+
+			if err := store.Delete("me@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Get("me@example.com"); !os.IsNotExist(err) {
+				t.Fatalf("expected a not exist error for a deleted token, got %v", err)
+			}
+			if _, err := store.Get("me+work@example.com"); err != nil {
+				t.Fatalf("expected the other token to still exist, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFileTokenStorePermissions(t *testing.T) {
+	file := writeTestFile(t, "token.json", `{"access_token":"access"}`)
+	store := &fileTokenStore{file: file}
+
+	if err := os.Chmod(file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("default"); err == nil || !strings.Contains(err.Error(), "can be accessed by other users") {
+		t.Fatalf("expected a permissions error, got %v", err)
+	}
+
+	if err := os.Chmod(file, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("default"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPassphraseCipherWrongPassphrase(t *testing.T) {
+	b, err := passphraseCipher{passphrase: "right"}.encrypt([]byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (passphraseCipher{passphrase: "wrong"}).decrypt(b); err == nil {
+		t.Fatal("expected an error decrypting with the wrong passphrase")
+	}
+
+	plaintext, err := passphraseCipher{passphrase: "right"}.decrypt(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "token" {
+		t.Fatalf("expected token, got %q", plaintext)
+	}
+}
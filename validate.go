@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jessfraz/gmailfilters/query"
+	"github.com/sirupsen/logrus"
+)
+
+const validateHelp = `Validate filter configuration files without making any API calls.`
+
+func (cmd *validateCommand) Name() string      { return "validate" }
+func (cmd *validateCommand) Args() string      { return "FILE..." }
+func (cmd *validateCommand) ShortHelp() string { return validateHelp }
+func (cmd *validateCommand) LongHelp() string  { return validateHelp }
+func (cmd *validateCommand) Hidden() bool      { return false }
+
+func (cmd *validateCommand) Register(fs *flag.FlagSet) {}
+
+type validateCommand struct{}
+
+func (cmd *validateCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("must pass a path to a gmail filter configuration file")
+	}
+
+	problems := 0
+	for _, file := range args {
+		_, err := decodeFile(file)
+		if err == nil {
+			fmt.Printf("%s is valid\n", file)
+			continue
+		}
+
+		errs, ok := err.(configErrors)
+		if !ok {
+			errs = configErrors{{pos: position{file: file}, msg: err.Error()}}
+		}
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+		problems += len(errs)
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+
+	return nil
+}
+
+// position is where something was defined in a config file.
+type position struct {
+	file string
+	line int
+}
+
+func (p position) String() string {
+	if p.line < 1 {
+		return p.file
+	}
+	return fmt.Sprintf("%s:%d", p.file, p.line)
+}
+
+// configError is a problem with a config file.
+type configError struct {
+	pos position
+	msg string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%s: %s", e.pos, e.msg)
+}
+
+// configErrors holds all the problems found in a config file.
+type configErrors []*configError
+
+func (e configErrors) Error() string {
+	s := make([]string, 0, len(e))
+	for _, err := range e {
+		s = append(s, err.Error())
+	}
+	return strings.Join(s, "\n")
+}
+
+// validateFilterfile checks a decoded filter file for keys we do not know and
+// for filters Gmail would reject.
+func validateFilterfile(file string, layout configLayout, undecoded []toml.Key, ff filterfile) configErrors {
+	var errs configErrors
+
+	// Find any keys we did not decode, like typos.
+	unknown := map[string]bool{}
+	for _, key := range undecoded {
+		unknown[key.String()] = true
+	}
+	for _, key := range undecoded {
+		// Only report the top most key we do not know about.
+		if len(key) > 1 && unknown[toml.Key(key[:len(key)-1]).String()] {
+			continue
+		}
+
+		name := key[len(key)-1]
+		if table, ok := blockTable(key[0], true); ok && len(key) == 2 {
+			msg := fmt.Sprintf("unknown %s key %q", blockTables[table], name)
+			if suggestion := query.Suggest(name, blockKeys(table)); len(suggestion) > 0 {
+				msg += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+			for _, line := range layout.keyLines(table, name) {
+				errs = append(errs, &configError{pos: position{file: file, line: line}, msg: msg})
+			}
+			continue
+		}
+
+		errs = append(errs, &configError{
+			pos: position{file: file, line: layout.top[key[0]]},
+			msg: fmt.Sprintf("unknown key %q", key.String()),
+		})
+	}
+
+	for _, f := range ff.Filter {
+		for _, problem := range f.validate() {
+			errs = append(errs, &configError{pos: f.pos, msg: problem})
+		}
+
+		// Gmail accepts queries with warnings, so only log them.
+		for _, problem := range f.lintQueries() {
+			if problem.Severity == query.Warning {
+				logrus.Warnf("%s: %s", f.pos, problem)
+			}
+		}
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].pos.line < errs[j].pos.line
+	})
+
+	return errs
+}
+
+// validate returns the problems with a filter that would make Gmail reject
+// it or that conflict with each other.
+func (f filter) validate() []string {
+	var problems []string
+
+	for _, problem := range f.lintQueries() {
+		if problem.Severity == query.Error {
+			problems = append(problems, fmt.Sprintf("invalid query: %s", problem))
+		}
+	}
+
+	if len(f.Query) > 0 && len(strings.TrimSpace(f.Query)) < 1 {
+		problems = append(problems, "query cannot be empty")
+	}
+	for _, q := range f.QueryOr {
+		if len(strings.TrimSpace(q)) < 1 {
+			problems = append(problems, "queryOr cannot contain an empty query")
+			break
+		}
+	}
+	if len(f.Query) > 0 && len(f.QueryOr) > 0 {
+		problems = append(problems, "cannot have both a query and a queryOr")
+	} else {
+		if len(f.QueryOr) > 0 {
+			f.Query = strings.Join(f.QueryOr, " OR ")
+		}
+		if _, err := f.criteria(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if f.Delete && (f.Archive || f.ArchiveUnlessToMe) {
+		problems = append(problems, "cannot have both delete and archive or archiveUnlessToMe")
+	}
+	if f.Archive && f.ArchiveUnlessToMe {
+		problems = append(problems, "cannot have both archive and archiveUnlessToMe")
+	}
+	if f.Important && f.NeverImportant {
+		problems = append(problems, "cannot have both important and neverImportant")
+	}
+	if _, ok := categories[strings.ToLower(f.Category)]; len(f.Category) > 0 && !ok {
+		problems = append(problems, fmt.Sprintf("invalid category %q, must be one of personal, social, promotions, updates or forums", f.Category))
+	}
+
+	if len(f.ForwardTo) > 0 {
+		if addr, err := mail.ParseAddress(f.ForwardTo); err != nil || addr.Address != f.ForwardTo {
+			problems = append(problems, fmt.Sprintf("invalid forwarding address %q", f.ForwardTo))
+		}
+	}
+
+	labels := append([]string{}, f.Labels...)
+	if len(f.Label) > 0 {
+		labels = append(labels, f.Label)
+	}
+	for _, label := range append(labels, f.RemoveLabels...) {
+		if err := validateLabelName(label); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, label := range labels {
+		for _, remove := range f.RemoveLabels {
+			if strings.EqualFold(label, remove) {
+				problems = append(problems, fmt.Sprintf("cannot both add and remove label %q", label))
+			}
+		}
+	}
+
+	return problems
+}
+
+// lintQueries returns the problems found in the queries of a filter.
+func (f filter) lintQueries() []query.Problem {
+	queries := append([]string{f.Query, f.NegatedQuery}, f.QueryOr...)
+
+	var problems []query.Problem
+	for _, q := range queries {
+		if len(strings.TrimSpace(q)) > 0 {
+			problems = append(problems, query.Lint(q)...)
+		}
+	}
+	return problems
+}
+
+// reservedLabels are the system label names that cannot be used as labels
+// in a filter. Most of them have a filter option instead.
+var reservedLabels = map[string]string{
+	"inbox":     "use archive instead",
+	"unread":    "use read instead",
+	"trash":     "use delete instead",
+	"spam":      "use neverSpam instead",
+	"starred":   "use star instead",
+	"important": "use important or neverImportant instead",
+	"sent":      "it cannot be applied by a filter",
+	"draft":     "it cannot be applied by a filter",
+	"chat":      "it cannot be applied by a filter",
+}
+
+// maxLabelLength is the longest label name Gmail allows.
+const maxLabelLength = 225
+
+// validateLabelName returns an error if Gmail would reject the label name.
+func validateLabelName(name string) error {
+	switch {
+	case len(strings.TrimSpace(name)) < 1:
+		return errors.New("label names cannot be empty")
+	case strings.TrimSpace(name) != name:
+		return fmt.Errorf("label %q cannot start or end with whitespace", name)
+	case strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/"):
+		return fmt.Errorf("label %q cannot start or end with a /", name)
+	case strings.Contains(name, "//"):
+		return fmt.Errorf("label %q cannot have an empty nested label", name)
+	case len(name) > maxLabelLength:
+		return fmt.Errorf("label %q is longer than %d characters", name, maxLabelLength)
+	}
+
+	if reason, ok := reservedLabels[strings.ToLower(name)]; ok {
+		return fmt.Errorf("label %q is a reserved Gmail label, %s", name, reason)
+	}
+
+	return nil
+}
+
+// filterConfigKeys returns the keys a filter can have in a config file.
+func filterConfigKeys() []string {
+	return configKeys(filter{})
+}
+
+// configKeys returns the keys of a struct decoded from a config file.
+func configKeys(v interface{}) []string {
+	var keys []string
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			keys = append(keys, configKeys(reflect.Zero(field.Type).Interface())...)
+			continue
+		}
+		if tag := field.Tag.Get("toml"); len(tag) > 0 {
+			keys = append(keys, strings.Split(tag, ",")[0])
+		}
+	}
+	return keys
+}
+
+// blockTables maps the arrays of tables we keep the lines of to the name used
+// for their tables in errors.
+var blockTables = map[string]string{
+	"filter":         "filter",
+	"filterTemplate": "filter template",
+}
+
+// blockTable returns the array of tables with the name passed, matching the
+// name case insensitively if asked to.
+func blockTable(name string, caseInsensitive bool) (string, bool) {
+	for table := range blockTables {
+		if table == name || (caseInsensitive && strings.EqualFold(table, name)) {
+			return table, true
+		}
+	}
+	return "", false
+}
+
+// blockKeys returns the keys a table in the array of tables can have.
+func blockKeys(table string) []string {
+	if table == "filterTemplate" {
+		return configKeys(filterTemplate{})
+	}
+	return filterConfigKeys()
+}
+
+// configLayout holds the lines things are defined on in a config file.
+type configLayout struct {
+	// blocks holds the line of each table in the arrays of tables, like
+	// the filters, and the lines of its keys.
+	blocks map[string][]configBlock
+	// top holds the lines of the top level keys and tables.
+	top map[string]int
+}
+
+type configBlock struct {
+	line int
+	keys map[string]int
+}
+
+var (
+	tomlArrayTableRegex = regexp.MustCompile(`^\s*\[\[\s*([^\]]+?)\s*\]\]`)
+	tomlTableRegex      = regexp.MustCompile(`^\s*\[\s*([^\]]+?)\s*\]`)
+	tomlKeyRegex        = regexp.MustCompile(`^\s*("[^"]*"|'[^']*'|[A-Za-z0-9_-]+)\s*=`)
+)
+
+// scanTOMLLayout scans a TOML file for the lines its filters and keys are
+// defined on. It only needs to understand enough TOML to skip over multi-line
+// strings.
+func scanTOMLLayout(data string) configLayout {
+	layout := newConfigLayout()
+
+	var (
+		inString string
+		block    *configBlock
+		inTable  bool
+	)
+	for i, line := range strings.Split(data, "\n") {
+		lineNum := i + 1
+
+		if len(inString) > 0 {
+			// Look for the end of the multi-line string.
+			if strings.Count(line, inString)%2 == 1 {
+				inString = ""
+			}
+			continue
+		}
+
+		switch {
+		case tomlArrayTableRegex.MatchString(line):
+			name := tomlArrayTableRegex.FindStringSubmatch(line)[1]
+			if _, ok := blockTables[name]; ok {
+				block = layout.addBlock(name, lineNum)
+			} else {
+				block = nil
+			}
+			inTable = true
+			if _, ok := layout.top[name]; !ok {
+				layout.top[name] = lineNum
+			}
+		case tomlTableRegex.MatchString(line):
+			name := tomlTableRegex.FindStringSubmatch(line)[1]
+			block = nil
+			inTable = true
+			if _, ok := layout.top[name]; !ok {
+				layout.top[name] = lineNum
+			}
+		case tomlKeyRegex.MatchString(line):
+			key := strings.Trim(tomlKeyRegex.FindStringSubmatch(line)[1], `"'`)
+			if block != nil {
+				block.keys[key] = lineNum
+			} else if !inTable {
+				layout.top[key] = lineNum
+			}
+		}
+
+		// Check if a multi-line string starts on this line.
+		for _, quote := range []string{`"""`, `'''`} {
+			if strings.Count(line, quote)%2 == 1 {
+				inString = quote
+				break
+			}
+		}
+	}
+
+	return layout
+}
+
+// newConfigLayout returns an empty layout.
+func newConfigLayout() configLayout {
+	return configLayout{blocks: map[string][]configBlock{}, top: map[string]int{}}
+}
+
+// addBlock adds a table to an array of tables and returns it.
+func (l configLayout) addBlock(table string, line int) *configBlock {
+	l.blocks[table] = append(l.blocks[table], configBlock{line: line, keys: map[string]int{}})
+	return &l.blocks[table][len(l.blocks[table])-1]
+}
+
+// keyLines returns the lines of every key with the name passed in the tables
+// of an array of tables.
+func (l configLayout) keyLines(table, name string) []int {
+	var lines []int
+	for _, block := range l.blocks[table] {
+		if line, ok := block.keys[name]; ok {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// blockLine returns the line of the nth table in an array of tables.
+func (l configLayout) blockLine(table string, n int) int {
+	if n < len(l.blocks[table]) {
+		return l.blocks[table][n].line
+	}
+	return 0
+}
+
+// unknownKeys returns the keys in the layout that are not filter config keys.
+// The keys of formats we decode case insensitively are matched that way.
+func (l configLayout) unknownKeys(caseInsensitive bool) []toml.Key {
+	known := func(keys []string, key string) bool {
+		for _, k := range keys {
+			if k == key || (caseInsensitive && strings.EqualFold(k, key)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var keys []toml.Key
+	top := make([]string, 0, len(l.top))
+	for key := range l.top {
+		top = append(top, key)
+	}
+	sort.Strings(top)
+	for _, key := range top {
+		if !known(configKeys(filterfile{}), key) {
+			keys = append(keys, toml.Key{key})
+		}
+	}
+
+	tables := make([]string, 0, len(l.blocks))
+	for table := range l.blocks {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		tableKeys := blockKeys(table)
+		seen := map[string]bool{}
+		for _, block := range l.blocks[table] {
+			names := make([]string, 0, len(block.keys))
+			for key := range block.keys {
+				names = append(names, key)
+			}
+			sort.Strings(names)
+			for _, key := range names {
+				if !seen[key] && !known(tableKeys, key) {
+					keys = append(keys, toml.Key{table, key})
+				}
+				seen[key] = true
+			}
+		}
+	}
+
+	return keys
+}
+
+// withoutLines returns the layout with all the lines unknown, for configs
+// generated from another file.
+func (l configLayout) withoutLines() configLayout {
+	layout := newConfigLayout()
+	for key := range l.top {
+		layout.top[key] = 0
+	}
+	for table, blocks := range l.blocks {
+		for _, block := range blocks {
+			b := layout.addBlock(table, 0)
+			for key := range block.keys {
+				b.keys[key] = 0
+			}
+		}
+	}
+	return layout
+}
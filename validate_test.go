@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDecodeFileValidation(t *testing.T) {
+	file := writeTestFile(t, "filters.toml", `fliter = 1
+
+[[filter]]
+query = "to:your_activity@noreply.github.com"
+archve = true
+read = true
+
+[[filter]]
+query = """
+from:notifications@github.com \
+-to:mention@noreply.github.com
+"""
+queryOr = ["to:author@noreply.github.com"]
+delete = true
+archive = true
+forwardTo = "not an address"
+
+[[filter]]
+query = " "
+label = "github//mentions"
+labels = ["INBOX"]
+removeLabels = ["github"]
+
+[[filter]]
+from = "notifications@github.com"
+label = "github"
+removeLabels = ["github"]
+
+[[filter]]
+queryOr = ["form:notifications@github.com", "(to:mention@noreply.github.com"]
+`)
+
+	_, err := decodeFile(file)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	errs, ok := err.(configErrors)
+	if !ok {
+		t.Fatalf("expected configErrors, got %T: %v", err, err)
+	}
+
+	expected := []string{
+		file + `:1: unknown key "fliter"`,
+		file + `:5: unknown filter key "archve", did you mean "archive"?`,
+		file + `:8: cannot have both a query and a queryOr`,
+		file + `:8: cannot have both delete and archive or archiveUnlessToMe`,
+		file + `:8: invalid forwarding address "not an address"`,
+		file + `:18: query cannot be empty`,
+		file + `:18: label "INBOX" is a reserved Gmail label, use archive instead`,
+		file + `:18: label "github//mentions" cannot have an empty nested label`,
+		file + `:24: cannot both add and remove label "github"`,
+		file + `:29: invalid query: unbalanced ( at column 1`,
+	}
+	if diff := cmp.Diff(expected, strings.Split(errs.Error(), "\n")); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestValidateLabelName(t *testing.T) {
+	for _, name := range []string{"github", "Mailing Lists/coreos-dev", "CATEGORY_UPDATES"} {
+		if err := validateLabelName(name); err != nil {
+			t.Fatalf("expected %q to be valid, got %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"", " github", "/github", "github/", "a//b", "Spam", strings.Repeat("a", 226)} {
+		if err := validateLabelName(name); err == nil {
+			t.Fatalf("expected %q to be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jessfraz/gmailfilters/query"
+)
+
+// varRegex matches a ${name} reference, or $$ for a literal $.
+var varRegex = regexp.MustCompile(`\$\$|\$\{([^}]*)\}`)
+
+// envPrefix is the prefix of references to environment variables, like
+// ${env:USER}.
+const envPrefix = "env:"
+
+// varScope holds the variables of the config files.
+type varScope struct {
+	vars map[string]string
+}
+
+// collectVars collects the variables and fragments of the files. A name can
+// be defined more than once as long as the value is the same.
+func collectVars(files []configFile) (varScope, configErrors) {
+	scope := varScope{vars: map[string]string{}}
+	defined := map[string]position{}
+
+	var errs configErrors
+	for _, f := range files {
+		for _, table := range []struct {
+			key  string
+			vars map[string]string
+		}{
+			{"vars", f.ff.Vars},
+			{"fragments", f.ff.Fragments},
+		} {
+			pos := position{file: f.name, line: f.layout.top[table.key]}
+
+			names := make([]string, 0, len(table.vars))
+			for name := range table.vars {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				value := table.vars[name]
+				if strings.HasPrefix(name, envPrefix) || strings.ContainsAny(name, "${}") {
+					errs = append(errs, &configError{pos: pos, msg: fmt.Sprintf("invalid variable name %q", name)})
+					continue
+				}
+				if v, ok := scope.vars[name]; ok && v != value {
+					errs = append(errs, &configError{pos: pos, msg: fmt.Sprintf("variable %q is already defined at %s", name, defined[name])})
+					continue
+				}
+				scope.vars[name] = value
+				defined[name] = pos
+			}
+		}
+	}
+
+	return scope, errs
+}
+
+// expandFilters expands the variables in the queries and forwarding address
+// of the filters.
+func (s varScope) expandFilters(filters []filter) configErrors {
+	var errs configErrors
+	for i := range filters {
+		f := &filters[i]
+
+		expand := func(key string, v *string) {
+			expanded, err := s.expand(*v)
+			if err != nil {
+				errs = append(errs, &configError{pos: f.pos, msg: fmt.Sprintf("%s: %v", key, err)})
+				return
+			}
+			*v = expanded
+		}
+		expand("query", &f.Query)
+		for j := range f.QueryOr {
+			expand("queryOr", &f.QueryOr[j])
+		}
+		expand("negatedQuery", &f.NegatedQuery)
+		expand("forwardTo", &f.ForwardTo)
+	}
+	return errs
+}
+
+// expand replaces the variable references in a value with their values.
+func (s varScope) expand(value string) (string, error) {
+	return s.expandRefs(value, nil)
+}
+
+// expandRefs expands a value found by following the references in stack, so
+// a variable that refers to itself is an error rather than a loop.
+func (s varScope) expandRefs(value string, stack []string) (string, error) {
+	var err error
+	expanded := varRegex.ReplaceAllStringFunc(value, func(ref string) string {
+		if err != nil {
+			return ref
+		}
+		if ref == "$$" {
+			return "$"
+		}
+
+		name := strings.TrimSpace(ref[2 : len(ref)-1])
+		if strings.HasPrefix(name, envPrefix) {
+			v, ok := os.LookupEnv(strings.TrimPrefix(name, envPrefix))
+			if !ok {
+				err = fmt.Errorf("environment variable %s is not set", strings.TrimPrefix(name, envPrefix))
+			}
+			return v
+		}
+
+		for i, n := range stack {
+			if n == name {
+				err = fmt.Errorf("variable cycle: %s", strings.Join(append(append([]string{}, stack[i:]...), name), " -> "))
+				return ref
+			}
+		}
+
+		v, ok := s.vars[name]
+		if !ok {
+			err = fmt.Errorf("undefined variable %q", name)
+			names := make([]string, 0, len(s.vars))
+			for n := range s.vars {
+				names = append(names, n)
+			}
+			if suggestion := query.Suggest(name, names); len(suggestion) > 0 {
+				err = fmt.Errorf("undefined variable %q, did you mean %q?", name, suggestion)
+			}
+			return ref
+		}
+
+		v, err = s.expandRefs(v, append(stack, name))
+		return v
+	})
+	return expanded, err
+}
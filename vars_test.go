@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExpandVars(t *testing.T) {
+	os.Setenv("GMAILFILTERS_TEST_ADDR", "me@example.com")
+	defer os.Unsetenv("GMAILFILTERS_TEST_ADDR")
+
+	s := varScope{vars: map[string]string{
+		"handles":         "(@jfrazelle OR @jessfraz)",
+		"github":          "notifications@github.com",
+		"github_mentions": "from:${github} ${handles}",
+		"self":            "${self}",
+		"a":               "${b}",
+		"b":               "${a}",
+	}}
+
+	testCases := []struct {
+		value    string
+		expected string
+		err      string
+	}{
+		{value: "from:(notifications@github.com)", expected: "from:(notifications@github.com)"},
+		{value: "${github_mentions} -label:muted", expected: "from:notifications@github.com (@jfrazelle OR @jessfraz) -label:muted"},
+		{value: "to:${ env:GMAILFILTERS_TEST_ADDR }", expected: "to:me@example.com"},
+		{value: "subject:$$${handles}", expected: "subject:$(@jfrazelle OR @jessfraz)"},
+		{value: "${github_mention}", err: `undefined variable "github_mention", did you mean "github_mentions"?`},
+		{value: "${env:GMAILFILTERS_TEST_UNSET}", err: "environment variable GMAILFILTERS_TEST_UNSET is not set"},
+		{value: "${self}", err: "variable cycle: self -> self"},
+		{value: "${a}", err: "variable cycle: a -> b -> a"},
+	}
+
+	for _, tc := range testCases {
+		got, err := s.expand(tc.value)
+		if len(tc.err) > 0 {
+			if err == nil || err.Error() != tc.err {
+				t.Fatalf("%s: expected error %q, got %v", tc.value, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.value, err)
+		}
+		if got != tc.expected {
+			t.Fatalf("%s: expected %q, got %q", tc.value, tc.expected, got)
+		}
+	}
+}
+
+func TestDecodeFileVars(t *testing.T) {
+	dir := writeTestDir(t, map[string]string{
+		"github.toml": `[vars]
+github = "notifications@github.com"
+
+[fragments]
+github_mentions = "to:mention@noreply.github.com OR to:author@noreply.github.com"
+`,
+		"filters.yaml": `include: [github.toml]
+filter:
+  - query: from:${github} (${github_mentions})
+    label: github/mentions
+  - queryOr: ["from:${github}", "from:noreply@github.com"]
+    forwardTo: ${fwd}
+    label: github
+  - query: from:${githb}
+    label: github
+vars:
+  fwd: archive@example.com
+  github: notifications@github.com
+`,
+	})
+
+	filters, err := decodeFile(filepath.Join(dir, "github.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 0 {
+		t.Fatalf("expected no filters, got %d", len(filters))
+	}
+
+	file := filepath.Join(dir, "filters.yaml")
+	_, err = decodeFile(file)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	expected := []string{
+		file + `:8: query: undefined variable "githb", did you mean "github"?`,
+	}
+	if diff := cmp.Diff(expected, strings.Split(err.Error(), "\n")); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+
+	// Fix the typo and check the expanded filters.
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(strings.Replace(string(b), "${githb}", "${github}", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	filters, err = decodeFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, f := range filters {
+		got = append(got, strings.Join(append([]string{f.Query, f.ForwardTo}, f.QueryOr...), "|"))
+	}
+	if diff := cmp.Diff([]string{
+		"from:notifications@github.com (to:mention@noreply.github.com OR to:author@noreply.github.com)|",
+		"|archive@example.com|from:notifications@github.com|from:noreply@github.com",
+		"from:notifications@github.com|",
+	}, got); len(diff) > 1 {
+		t.Fatalf("got diff: %s", diff)
+	}
+}
+
+func TestCollectVarsConflict(t *testing.T) {
+	dir := writeTestDir(t, map[string]string{
+		"a.toml": `[vars]
+github = "notifications@github.com"
+`,
+		"b.toml": `
+[fragments]
+github = "noreply@github.com"
+`,
+	})
+
+	_, err := decodeFile(dir)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	expected := filepath.Join(dir, "b.toml") + `:2: variable "github" is already defined at ` + filepath.Join(dir, "a.toml") + ":1"
+	if err.Error() != expected {
+		t.Fatalf("expected %q, got %q", expected, err.Error())
+	}
+}